@@ -4,9 +4,10 @@ import (
 	"context"
 
 	"github.com/rancher/multi-cluster-app/controllers/globaldns"
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers/embedded"
 	"github.com/rancher/types/config"
 )
 
-func Register(ctx context.Context, management *config.ManagementContext) {
-	globaldns.Register(ctx, management)
+func Register(ctx context.Context, management *config.ManagementContext, dnsServer *embedded.Server) {
+	globaldns.Register(ctx, management, dnsServer)
 }
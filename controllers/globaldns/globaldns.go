@@ -3,10 +3,12 @@ package globaldns
 import (
 	"strings"
 
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers/embedded"
 	"github.com/rancher/norman/types"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -17,12 +19,14 @@ type GlobalDNSController struct {
 	Schemas            *types.Schemas
 	globalDNSInterface v3.GlobalDNSInterface
 	globalDNSLister    v3.GlobalDNSLister
+	dnsServer          *embedded.Server
 }
 
-func newGlobalDNSController(mgmt *config.ManagementContext) *GlobalDNSController {
+func newGlobalDNSController(mgmt *config.ManagementContext, dnsServer *embedded.Server) *GlobalDNSController {
 	n := &GlobalDNSController{
 		globalDNSInterface: mgmt.Management.GlobalDNSs(""),
 		globalDNSLister:    mgmt.Management.GlobalDNSs("").Controller().Lister(),
+		dnsServer:          dnsServer,
 	}
 	return n
 }
@@ -30,6 +34,12 @@ func newGlobalDNSController(mgmt *config.ManagementContext) *GlobalDNSController
 //sync is called periodically and on real updates
 func (n *GlobalDNSController) sync(key string, obj *v3.GlobalDNS) error {
 	logrus.Debugf("GlobalDNSController called")
+	if n.dnsServer != nil {
+		if err := n.syncZones(); err != nil {
+			return err
+		}
+	}
+
 	if obj == nil || obj.DeletionTimestamp != nil {
 		return nil
 	}
@@ -43,3 +53,19 @@ func (n *GlobalDNSController) sync(key string, obj *v3.GlobalDNS) error {
 	}
 	return nil
 }
+
+// syncZones makes the embedded DNS server authoritative for the root domain of every GlobalDNS using it
+func (n *GlobalDNSController) syncZones() error {
+	globalDNSs, err := n.globalDNSLister.List("", labels.Everything())
+	if err != nil {
+		return err
+	}
+	var zones []string
+	for _, globalDNS := range globalDNSs {
+		if globalDNS.DeletionTimestamp == nil && globalDNS.ProviderName == embedded.ProviderName {
+			zones = append(zones, globalDNS.RootDomain)
+		}
+	}
+	n.dnsServer.SetZones(zones)
+	return nil
+}
@@ -0,0 +1,319 @@
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+)
+
+const (
+	DefaultBaseURL = "https://api.cloudflare.com/client/v4"
+
+	perPage       = 100
+	clientTimeout = 30 * time.Second
+	// automaticTTL is what Cloudflare requires for proxied records.
+	automaticTTL = 1
+)
+
+type Config struct {
+	APIToken string
+	// BaseURL overrides the Cloudflare API URL, e.g. to point at an
+	// httptest server.
+	BaseURL string
+	// Proxied routes A, AAAA and CNAME records through Cloudflare.
+	Proxied bool
+}
+
+type Provider struct {
+	config     Config
+	httpClient *http.Client
+
+	lock    sync.Mutex
+	zoneIDs map[string]string
+}
+
+type dnsRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+	Proxied bool   `json:"proxied,omitempty"`
+}
+
+type zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type response struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+func NewProvider(config Config) *Provider {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultBaseURL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	return &Provider{
+		config:     config,
+		httpClient: &http.Client{Timeout: clientTimeout},
+		zoneIDs:    map[string]string{},
+	}
+}
+
+func (p *Provider) Records(zone string) ([]providers.Record, error) {
+	zoneID, err := p.zoneID(zone)
+	if err != nil {
+		return nil, err
+	}
+	dnsRecords, err := p.listRecords(zoneID, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []providers.Record
+	index := map[string]int{}
+	for _, r := range dnsRecords {
+		name := providers.Fqdn(r.Name)
+		key := name + "/" + r.Type
+		if i, ok := index[key]; ok {
+			records[i].Targets = append(records[i].Targets, r.Content)
+			continue
+		}
+		index[key] = len(records)
+		records = append(records, providers.Record{
+			Name:    name,
+			Type:    r.Type,
+			TTL:     r.TTL,
+			Targets: []string{r.Content},
+		})
+	}
+	return records, nil
+}
+
+// ApplyChanges brings each changed name and type in line with the change.
+// Cloudflare keeps one record per target, so an upsert updates existing
+// records in place, creates the missing ones and removes the rest.
+func (p *Provider) ApplyChanges(zone string, changes []providers.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	zoneID, err := p.zoneID(zone)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		name := strings.TrimSuffix(providers.Fqdn(change.Record.Name), ".")
+		existing, err := p.listRecords(zoneID, url.Values{
+			"name": []string{name},
+			"type": []string{change.Record.Type},
+		})
+		if err != nil {
+			return err
+		}
+
+		var desired []string
+		switch change.Action {
+		case providers.ActionCreate:
+			if len(existing) > 0 {
+				return fmt.Errorf("cloudflare: %s %s already exists", change.Record.Type, name)
+			}
+			desired = change.Record.Targets
+		case providers.ActionUpsert:
+			desired = change.Record.Targets
+		}
+		if err := p.reconcile(zoneID, name, change.Record, existing, desired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile reuses the IDs of stale records for missing targets and only
+// deletes what is left over after creating the rest, so the name never
+// goes without records while it changes.
+func (p *Provider) reconcile(zoneID, name string, record providers.Record, existing []dnsRecord, desired []string) error {
+	path := "/zones/" + zoneID + "/dns_records"
+	wanted := map[string]bool{}
+	for _, target := range desired {
+		wanted[normalize(record.Type, target)] = true
+	}
+
+	var stale []dnsRecord
+	for _, r := range existing {
+		r.Content = normalize(r.Type, r.Content)
+		if !wanted[r.Content] {
+			stale = append(stale, r)
+			continue
+		}
+		delete(wanted, r.Content)
+		update := p.toDNSRecord(name, record, r.Content)
+		if r.TTL != update.TTL || r.Proxied != update.Proxied {
+			if _, err := p.do(http.MethodPut, path+"/"+r.ID, nil, update, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, target := range desired {
+		target = normalize(record.Type, target)
+		if !wanted[target] {
+			continue
+		}
+		delete(wanted, target)
+		if len(stale) > 0 {
+			if _, err := p.do(http.MethodPut, path+"/"+stale[0].ID, nil, p.toDNSRecord(name, record, target), nil); err != nil {
+				return err
+			}
+			stale = stale[1:]
+			continue
+		}
+		if _, err := p.do(http.MethodPost, path, nil, p.toDNSRecord(name, record, target), nil); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range stale {
+		if _, err := p.do(http.MethodDelete, path+"/"+r.ID, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Provider) toDNSRecord(name string, record providers.Record, content string) dnsRecord {
+	r := dnsRecord{
+		Type:    record.Type,
+		Name:    name,
+		Content: content,
+		TTL:     record.TTL,
+	}
+	if p.config.Proxied && (r.Type == "A" || r.Type == "AAAA" || r.Type == "CNAME") {
+		r.Proxied = true
+		r.TTL = automaticTTL
+	}
+	return r
+}
+
+// normalize returns content as Cloudflare stores it, so desired and
+// existing records compare equal.
+func normalize(rtype, content string) string {
+	if rtype == "CNAME" {
+		return strings.ToLower(strings.TrimSuffix(content, "."))
+	}
+	return content
+}
+
+func (p *Provider) listRecords(zoneID string, query url.Values) ([]dnsRecord, error) {
+	var records []dnsRecord
+	query.Set("per_page", strconv.Itoa(perPage))
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var result []dnsRecord
+		resp, err := p.do(http.MethodGet, "/zones/"+zoneID+"/dns_records", query, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, result...)
+		if page >= resp.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+func (p *Provider) zoneID(name string) (string, error) {
+	name = strings.TrimSuffix(providers.Fqdn(name), ".")
+
+	p.lock.Lock()
+	id, ok := p.zoneIDs[name]
+	p.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var zones []zone
+	if _, err := p.do(http.MethodGet, "/zones", url.Values{"name": []string{name}}, nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("cloudflare: no zone found for %s", name)
+	}
+
+	p.lock.Lock()
+	p.zoneIDs[name] = zones[0].ID
+	p.lock.Unlock()
+	return zones[0].ID, nil
+}
+
+// do calls the API and decodes the result field of the response into out if
+// it is not nil.
+func (p *Provider) do(method, path string, query url.Values, in, out interface{}) (*response, error) {
+	u := p.config.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.config.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &response{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("cloudflare: %s %s: %d: %v", method, path, httpResp.StatusCode, err)
+	}
+	if !resp.Success {
+		var messages []string
+		for _, e := range resp.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("cloudflare: %s %s: %d: %s", method, path, httpResp.StatusCode,
+			strings.Join(messages, ", "))
+	}
+	if out != nil && len(resp.Result) > 0 {
+		if err := json.Unmarshal(resp.Result, out); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
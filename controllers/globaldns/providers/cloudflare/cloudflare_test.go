@@ -0,0 +1,338 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+)
+
+const testPageSize = 2
+
+// fakeAPI is an in-memory stand-in for the zones and dns_records endpoints
+// of the Cloudflare v4 API. It pages results testPageSize at a time.
+type fakeAPI struct {
+	sync.Mutex
+	records map[string]dnsRecord
+	nextID  int
+	calls   []string
+}
+
+func newFakeAPI(records ...dnsRecord) *fakeAPI {
+	f := &fakeAPI{records: map[string]dnsRecord{}}
+	for _, r := range records {
+		f.nextID++
+		r.ID = strconv.Itoa(f.nextID)
+		f.records[r.ID] = r
+	}
+	return f
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}],"result":null}`))
+		return
+	}
+
+	const recordsPath = "/zones/zone1/dns_records"
+	switch {
+	case r.URL.Path == "/zones":
+		f.reply(w, []zone{{ID: "zone1", Name: "example.com"}}, 1, 1)
+	case r.URL.Path == recordsPath && r.Method == http.MethodGet:
+		query := r.URL.Query()
+		var matched []dnsRecord
+		for _, record := range f.records {
+			if (query.Get("name") == "" || record.Name == query.Get("name")) &&
+				(query.Get("type") == "" || record.Type == query.Get("type")) {
+				matched = append(matched, record)
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+		page, _ := strconv.Atoi(query.Get("page"))
+		totalPages := (len(matched) + testPageSize - 1) / testPageSize
+		start, end := (page-1)*testPageSize, page*testPageSize
+		if start > len(matched) {
+			start = len(matched)
+		}
+		if end > len(matched) {
+			end = len(matched)
+		}
+		f.reply(w, matched[start:end], page, totalPages)
+	case r.URL.Path == recordsPath && r.Method == http.MethodPost:
+		record := dnsRecord{}
+		json.NewDecoder(r.Body).Decode(&record)
+		f.nextID++
+		record.ID = strconv.Itoa(f.nextID)
+		f.records[record.ID] = record
+		f.calls = append(f.calls, "POST "+record.Content)
+		f.reply(w, record, 1, 1)
+	case strings.HasPrefix(r.URL.Path, recordsPath+"/"):
+		id := strings.TrimPrefix(r.URL.Path, recordsPath+"/")
+		existing, ok := f.records[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}],"result":null}`))
+			return
+		}
+		if r.Method == http.MethodDelete {
+			f.calls = append(f.calls, "DELETE "+existing.Content)
+			delete(f.records, id)
+			f.reply(w, map[string]string{"id": id}, 1, 1)
+			return
+		}
+		record := dnsRecord{}
+		json.NewDecoder(r.Body).Decode(&record)
+		if record.Content != existing.Content {
+			f.calls = append(f.calls, "PUT "+existing.Content+" -> "+record.Content)
+		} else {
+			f.calls = append(f.calls, "PUT "+existing.Content)
+		}
+		record.ID = id
+		f.records[id] = record
+		f.reply(w, record, 1, 1)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAPI) reply(w http.ResponseWriter, result interface{}, page, totalPages int) {
+	data, _ := json.Marshal(result)
+	fmt.Fprintf(w, `{"success":true,"errors":[],"result":%s,"result_info":{"page":%d,"total_pages":%d}}`,
+		data, page, totalPages)
+}
+
+func (f *fakeAPI) contents(name, rtype string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var result []string
+	for _, record := range f.records {
+		if record.Name == name && record.Type == rtype {
+			result = append(result, fmt.Sprintf("%s ttl=%d proxied=%v", record.Content, record.TTL, record.Proxied))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func newTestProvider(f *fakeAPI, proxied bool) (*Provider, *httptest.Server) {
+	server := httptest.NewServer(f)
+	return NewProvider(Config{APIToken: "token", BaseURL: server.URL, Proxied: proxied}), server
+}
+
+func change(action string, ttl int64, targets ...string) []providers.Change {
+	return []providers.Change{{
+		Action: action,
+		Record: providers.Record{Name: "app.example.com.", Type: "A", TTL: ttl, Targets: targets},
+	}}
+}
+
+func TestApplyChangesReconcilesTargets(t *testing.T) {
+	f := newFakeAPI(
+		dnsRecord{Type: "A", Name: "app.example.com", Content: "1.1.1.1", TTL: 60},
+		dnsRecord{Type: "A", Name: "app.example.com", Content: "2.2.2.2", TTL: 300},
+		dnsRecord{Type: "A", Name: "app.example.com", Content: "3.3.3.3", TTL: 60},
+		dnsRecord{Type: "A", Name: "other.example.com", Content: "9.9.9.9", TTL: 60},
+	)
+	p, server := newTestProvider(f, false)
+	defer server.Close()
+
+	if err := p.ApplyChanges("example.com", change(providers.ActionUpsert, 60, "1.1.1.1", "2.2.2.2", "4.4.4.4")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1.1.1.1 is unchanged, 2.2.2.2 gets the new TTL and 3.3.3.3 is
+	// replaced by 4.4.4.4
+	expectedCalls := "PUT 2.2.2.2, PUT 3.3.3.3 -> 4.4.4.4"
+	if calls := strings.Join(f.calls, ", "); calls != expectedCalls {
+		t.Fatalf("expected calls %s, got %s", expectedCalls, calls)
+	}
+	expected := []string{"1.1.1.1 ttl=60 proxied=false", "2.2.2.2 ttl=60 proxied=false", "4.4.4.4 ttl=60 proxied=false"}
+	if got := f.contents("app.example.com", "A"); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if err := p.ApplyChanges("example.com", change(providers.ActionDelete, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.contents("app.example.com", "A"); len(got) != 0 {
+		t.Fatalf("expected all records to be deleted, got %v", got)
+	}
+	if got := f.contents("other.example.com", "A"); len(got) != 1 {
+		t.Fatalf("expected unrelated record to be kept, got %v", got)
+	}
+}
+
+func TestApplyChangesProxied(t *testing.T) {
+	f := newFakeAPI(dnsRecord{Type: "A", Name: "app.example.com", Content: "1.1.1.1", TTL: 60})
+	p, server := newTestProvider(f, true)
+	defer server.Close()
+
+	if err := p.ApplyChanges("example.com", change(providers.ActionUpsert, 60, "1.1.1.1", "2.2.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1.1.1.1 ttl=1 proxied=true", "2.2.2.2 ttl=1 proxied=true"}
+	if got := f.contents("app.example.com", "A"); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// TXT records can't be proxied and keep their TTL
+	txt := []providers.Change{{
+		Action: providers.ActionUpsert,
+		Record: providers.Record{Name: "app.example.com", Type: "TXT", TTL: 300, Targets: []string{"owner"}},
+	}}
+	if err := p.ApplyChanges("example.com", txt); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.contents("app.example.com", "TXT"); len(got) != 1 || got[0] != "owner ttl=300 proxied=false" {
+		t.Fatalf("expected unproxied TXT record, got %v", got)
+	}
+}
+
+func TestApplyChangesNeverEmptiesName(t *testing.T) {
+	tests := []struct {
+		name     string
+		rtype    string
+		existing []string
+		desired  []string
+		calls    string
+	}{
+		{
+			name:     "swap a single target",
+			rtype:    "A",
+			existing: []string{"1.1.1.1"},
+			desired:  []string{"2.2.2.2"},
+			calls:    "PUT 1.1.1.1 -> 2.2.2.2",
+		},
+		{
+			name:     "grow",
+			rtype:    "A",
+			existing: []string{"1.1.1.1"},
+			desired:  []string{"2.2.2.2", "3.3.3.3"},
+			calls:    "PUT 1.1.1.1 -> 2.2.2.2, POST 3.3.3.3",
+		},
+		{
+			name:     "shrink",
+			rtype:    "A",
+			existing: []string{"1.1.1.1", "2.2.2.2"},
+			desired:  []string{"3.3.3.3"},
+			calls:    "PUT 1.1.1.1 -> 3.3.3.3, DELETE 2.2.2.2",
+		},
+		{
+			name:     "replace a CNAME",
+			rtype:    "CNAME",
+			existing: []string{"a.example.org"},
+			desired:  []string{"b.example.org."},
+			calls:    "PUT a.example.org -> b.example.org",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var existing []dnsRecord
+			for _, content := range test.existing {
+				existing = append(existing, dnsRecord{Type: test.rtype, Name: "app.example.com", Content: content, TTL: 60})
+			}
+			f := newFakeAPI(existing...)
+			p, server := newTestProvider(f, false)
+			defer server.Close()
+
+			changes := []providers.Change{{
+				Action: providers.ActionUpsert,
+				Record: providers.Record{Name: "app.example.com.", Type: test.rtype, TTL: 60, Targets: test.desired},
+			}}
+			if err := p.ApplyChanges("example.com", changes); err != nil {
+				t.Fatal(err)
+			}
+			if calls := strings.Join(f.calls, ", "); calls != test.calls {
+				t.Fatalf("expected calls %s, got %s", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestApplyChangesCNAMEIsIdempotent(t *testing.T) {
+	f := newFakeAPI()
+	p, server := newTestProvider(f, false)
+	defer server.Close()
+
+	cname := []providers.Change{{
+		Action: providers.ActionUpsert,
+		Record: providers.Record{Name: "www.example.com.", Type: "CNAME", TTL: 60, Targets: []string{"LB.Example.org."}},
+	}}
+	for i := 0; i < 2; i++ {
+		if err := p.ApplyChanges("example.com", cname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := strings.Join(f.calls, ", "); calls != "POST lb.example.org" {
+		t.Fatalf("expected a single POST, got %s", calls)
+	}
+	if got := f.contents("www.example.com", "CNAME"); len(got) != 1 || got[0] != "lb.example.org ttl=60 proxied=false" {
+		t.Fatalf("expected the CNAME to be created once, got %v", got)
+	}
+}
+
+func TestRecordsPagination(t *testing.T) {
+	f := newFakeAPI(
+		dnsRecord{Type: "A", Name: "a.example.com", Content: "1.1.1.1", TTL: 60},
+		dnsRecord{Type: "A", Name: "a.example.com", Content: "2.2.2.2", TTL: 60},
+		dnsRecord{Type: "AAAA", Name: "a.example.com", Content: "2001:db8::1", TTL: 60},
+		dnsRecord{Type: "CNAME", Name: "b.example.com", Content: "a.example.com", TTL: 120},
+		dnsRecord{Type: "A", Name: "a.example.com", Content: "3.3.3.3", TTL: 60},
+	)
+	p, server := newTestProvider(f, false)
+	defer server.Close()
+
+	records, err := p.Records("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, record := range records {
+		got = append(got, fmt.Sprintf("%s %s %d %v", record.Name, record.Type, record.TTL, record.Targets))
+	}
+	expected := []string{
+		"a.example.com. A 60 [1.1.1.1 2.2.2.2 3.3.3.3]",
+		"a.example.com. AAAA 60 [2001:db8::1]",
+		"b.example.com. CNAME 120 [a.example.com]",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	f := newFakeAPI()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	p := NewProvider(Config{APIToken: "wrong", BaseURL: server.URL})
+
+	_, err := p.Records("example.com")
+	if err == nil || !strings.Contains(err.Error(), "9109 Invalid access token") {
+		t.Fatalf("expected API error, got %v", err)
+	}
+}
+
+func TestApplyChangesCreateFailsIfExists(t *testing.T) {
+	f := newFakeAPI(dnsRecord{Type: "A", Name: "app.example.com", Content: "1.1.1.1", TTL: 60})
+	p, server := newTestProvider(f, false)
+	defer server.Close()
+
+	if err := p.ApplyChanges("example.com", change(providers.ActionCreate, 60, "2.2.2.2")); err == nil {
+		t.Fatal("expected create of an existing record to fail")
+	}
+	if len(f.calls) != 0 {
+		t.Fatalf("expected no changes, got %v", f.calls)
+	}
+}
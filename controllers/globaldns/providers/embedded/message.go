@@ -0,0 +1,309 @@
+package embedded
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	typeA     uint16 = 1
+	typeNS    uint16 = 2
+	typeCNAME uint16 = 5
+	typeSOA   uint16 = 6
+	typeTXT   uint16 = 16
+	typeAAAA  uint16 = 28
+	typeOPT   uint16 = 41
+	typeANY   uint16 = 255
+
+	classINET uint16 = 1
+	classANY  uint16 = 255
+
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeNameError      = 3
+	rcodeNotImplemented = 4
+	rcodeRefused        = 5
+
+	headerLen      = 12
+	maxUDPSize     = 512
+	maxEDNSUDPSize = 4096
+)
+
+var (
+	typeNames = map[uint16]string{
+		typeA:     "A",
+		typeNS:    "NS",
+		typeCNAME: "CNAME",
+		typeSOA:   "SOA",
+		typeTXT:   "TXT",
+		typeAAAA:  "AAAA",
+	}
+	typeValues = map[string]uint16{}
+
+	errMalformed = errors.New("malformed message")
+)
+
+func init() {
+	for value, name := range typeNames {
+		typeValues[name] = value
+	}
+}
+
+type header struct {
+	id      uint16
+	flags   uint16
+	qdCount uint16
+	anCount uint16
+	nsCount uint16
+	arCount uint16
+}
+
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// query is the part of a request needed to answer it.
+type query struct {
+	header   header
+	question question
+	// udpSize is the largest UDP response the client accepts, raised above
+	// 512 by an EDNS OPT record.
+	udpSize int
+	edns    bool
+}
+
+type resourceRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+func parseQuery(msg []byte) (*query, error) {
+	if len(msg) < headerLen {
+		return nil, errMalformed
+	}
+	q := &query{
+		header: header{
+			id:      binary.BigEndian.Uint16(msg[0:]),
+			flags:   binary.BigEndian.Uint16(msg[2:]),
+			qdCount: binary.BigEndian.Uint16(msg[4:]),
+			anCount: binary.BigEndian.Uint16(msg[6:]),
+			nsCount: binary.BigEndian.Uint16(msg[8:]),
+			arCount: binary.BigEndian.Uint16(msg[10:]),
+		},
+		udpSize: maxUDPSize,
+	}
+	if q.header.qdCount != 1 {
+		return q, errMalformed
+	}
+
+	name, off, err := readName(msg, headerLen)
+	if err != nil || off+4 > len(msg) {
+		return q, errMalformed
+	}
+	q.question = question{
+		name:  name,
+		qtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+	}
+	off += 4
+
+	// skip answer and authority records and look for an OPT record in the
+	// additional section
+	for i := 0; i < int(q.header.anCount)+int(q.header.nsCount)+int(q.header.arCount); i++ {
+		var rrType, rrClass uint16
+		var rdLen int
+		if _, off, err = readName(msg, off); err != nil || off+10 > len(msg) {
+			return q, errMalformed
+		}
+		rrType = binary.BigEndian.Uint16(msg[off:])
+		rrClass = binary.BigEndian.Uint16(msg[off+2:])
+		rdLen = int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10 + rdLen
+		if off > len(msg) {
+			return q, errMalformed
+		}
+		if rrType == typeOPT {
+			q.edns = true
+			if size := int(rrClass); size > maxUDPSize {
+				q.udpSize = size
+			}
+			if q.udpSize > maxEDNSUDPSize {
+				q.udpSize = maxEDNSUDPSize
+			}
+		}
+	}
+	return q, nil
+}
+
+// readName decodes a possibly compressed name starting at off and returns it
+// with a trailing dot, along with the offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > 63 {
+				label = label[:63]
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// validName reports whether name can be encoded without changing it: every
+// label is 1 to 63 bytes and the encoded name is at most 255 bytes.
+func validName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name)+2 > 255 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// rdata encodes target as the RDATA of a record of type rtype. ok is false
+// if target is not valid for the type.
+func rdata(rtype uint16, target string) ([]byte, bool) {
+	switch rtype {
+	case typeA:
+		ip := net.ParseIP(target).To4()
+		return ip, ip != nil
+	case typeAAAA:
+		ip := net.ParseIP(target)
+		if ip == nil || ip.To4() != nil {
+			return nil, false
+		}
+		return ip.To16(), true
+	case typeCNAME, typeNS:
+		if !validName(target) {
+			return nil, false
+		}
+		return appendName(nil, target), true
+	case typeTXT:
+		var b []byte
+		for len(target) > 255 {
+			b = append(b, 255)
+			b = append(b, target[:255]...)
+			target = target[255:]
+		}
+		b = append(b, byte(len(target)))
+		return append(b, target...), true
+	}
+	return nil, false
+}
+
+func soaData(mname, rname string, serial, refresh, retry, expire, minimum uint32) []byte {
+	b := appendName(nil, mname)
+	b = appendName(b, rname)
+	b = appendUint32(b, serial)
+	b = appendUint32(b, refresh)
+	b = appendUint32(b, retry)
+	b = appendUint32(b, expire)
+	return appendUint32(b, minimum)
+}
+
+// response builds the reply to q. If it does not fit in limit bytes the
+// records are dropped and the TC bit is set so the client retries over TCP.
+func response(q *query, flags uint16, rcode int, answer, authority []resourceRecord, limit int) []byte {
+	flags |= 1 << 15                   // QR
+	flags |= q.header.flags & (1 << 8) // RD
+	flags |= uint16(rcode)
+
+	msg := encode(q, flags, answer, authority)
+	if limit > 0 && len(msg) > limit {
+		msg = encode(q, flags|1<<9, nil, nil) // TC
+	}
+	return msg
+}
+
+func encode(q *query, flags uint16, answer, authority []resourceRecord) []byte {
+	var arCount uint16
+	if q.edns {
+		arCount = 1
+	}
+
+	b := make([]byte, 0, maxUDPSize)
+	b = appendUint16(b, q.header.id)
+	b = appendUint16(b, flags)
+	b = appendUint16(b, 1)
+	b = appendUint16(b, uint16(len(answer)))
+	b = appendUint16(b, uint16(len(authority)))
+	b = appendUint16(b, arCount)
+
+	b = appendName(b, q.question.name)
+	b = appendUint16(b, q.question.qtype)
+	b = appendUint16(b, q.question.class)
+
+	for _, section := range [][]resourceRecord{answer, authority} {
+		for _, rr := range section {
+			b = appendName(b, rr.name)
+			b = appendUint16(b, rr.rtype)
+			b = appendUint16(b, classINET)
+			b = appendUint32(b, rr.ttl)
+			b = appendUint16(b, uint16(len(rr.data)))
+			b = append(b, rr.data...)
+		}
+	}
+	if q.edns {
+		// OPT: root name, advertised UDP size in the class field
+		b = appendName(b, ".")
+		b = appendUint16(b, typeOPT)
+		b = appendUint16(b, maxEDNSUDPSize)
+		b = appendUint32(b, 0)
+		b = appendUint16(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,303 @@
+package embedded
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// buildQuery encodes a query for name and qtype. A positive ednsSize adds an
+// OPT record advertising that UDP size.
+func buildQuery(name string, qtype uint16, ednsSize int) []byte {
+	var arCount uint16
+	if ednsSize > 0 {
+		arCount = 1
+	}
+	b := appendUint16(nil, 0x1234)
+	b = appendUint16(b, 1<<8) // RD
+	b = appendUint16(b, 1)
+	b = appendUint16(b, 0)
+	b = appendUint16(b, 0)
+	b = appendUint16(b, arCount)
+	b = appendName(b, name)
+	b = appendUint16(b, qtype)
+	b = appendUint16(b, classINET)
+	if ednsSize > 0 {
+		b = appendName(b, ".")
+		b = appendUint16(b, typeOPT)
+		b = appendUint16(b, uint16(ednsSize))
+		b = appendUint32(b, 0)
+		b = appendUint16(b, 0)
+	}
+	return b
+}
+
+type testResponse struct {
+	flags     uint16
+	rcode     int
+	answer    []string
+	authority []string
+	edns      bool
+}
+
+func (r *testResponse) truncated() bool     { return r.flags&(1<<9) != 0 }
+func (r *testResponse) authoritative() bool { return r.flags&(1<<10) != 0 }
+
+// parseResponse decodes msg and formats every answer and authority record
+// as "name ttl type data".
+func parseResponse(t *testing.T, msg []byte) *testResponse {
+	t.Helper()
+	if len(msg) < headerLen {
+		t.Fatalf("response too short: %d bytes", len(msg))
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	resp := &testResponse{flags: flags, rcode: int(flags & 0xF)}
+	if flags&(1<<15) == 0 {
+		t.Fatal("response does not have the QR bit set")
+	}
+
+	_, off, err := readName(msg, headerLen)
+	if err != nil {
+		t.Fatalf("invalid question: %v", err)
+	}
+	off += 4
+
+	counts := []int{
+		int(binary.BigEndian.Uint16(msg[6:])),
+		int(binary.BigEndian.Uint16(msg[8:])),
+		int(binary.BigEndian.Uint16(msg[10:])),
+	}
+	sections := []*[]string{&resp.answer, &resp.authority, nil}
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			var name string
+			if name, off, err = readName(msg, off); err != nil || off+10 > len(msg) {
+				t.Fatalf("invalid record in section %d: %v", i, err)
+			}
+			rtype := binary.BigEndian.Uint16(msg[off:])
+			ttl := binary.BigEndian.Uint32(msg[off+4:])
+			rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+			data := msg[off+10 : off+10+rdLen]
+			off += 10 + rdLen
+			if sections[i] == nil {
+				resp.edns = resp.edns || rtype == typeOPT
+				continue
+			}
+			*sections[i] = append(*sections[i], fmt.Sprintf("%s %d %s %s", name, ttl, typeNames[rtype], formatData(t, rtype, data)))
+		}
+	}
+	if off != len(msg) {
+		t.Fatalf("%d trailing bytes in response", len(msg)-off)
+	}
+	return resp
+}
+
+func formatData(t *testing.T, rtype uint16, data []byte) string {
+	switch rtype {
+	case typeA, typeAAAA:
+		return net.IP(data).String()
+	case typeCNAME, typeNS:
+		name, _, err := readName(data, 0)
+		if err != nil {
+			t.Fatalf("invalid name in rdata: %v", err)
+		}
+		return name
+	case typeTXT:
+		var parts []string
+		for len(data) > 0 {
+			parts = append(parts, string(data[1:1+int(data[0])]))
+			data = data[1+int(data[0]):]
+		}
+		return strings.Join(parts, "")
+	case typeSOA:
+		mname, off, _ := readName(data, 0)
+		_, off, _ = readName(data, off)
+		return fmt.Sprintf("%s minimum=%d", mname, binary.BigEndian.Uint32(data[off+16:]))
+	}
+	return fmt.Sprintf("%x", data)
+}
+
+func TestReadName(t *testing.T) {
+	header := make([]byte, headerLen)
+	tests := []struct {
+		name     string
+		msg      []byte
+		off      int
+		expected string
+		end      int
+		err      bool
+	}{
+		{
+			name:     "plain name keeps its case",
+			msg:      appendName(header, "App.Example.com"),
+			off:      headerLen,
+			expected: "App.Example.com.",
+			end:      headerLen + 17,
+		},
+		{
+			name:     "compression pointer",
+			msg:      append(appendName(header, "example.com"), 3, 'a', 'p', 'p', 0xC0, headerLen),
+			off:      headerLen + 13,
+			expected: "app.example.com.",
+			end:      headerLen + 19,
+		},
+		{
+			name: "pointer to itself",
+			msg:  append(header, 0xC0, headerLen),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "pointers to each other",
+			msg:  append(header, 0xC0, headerLen+2, 0xC0, headerLen),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "label and pointer loop",
+			msg:  append(header, 1, 'a', 0xC0, headerLen),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "pointer past the end",
+			msg:  append(header, 0xC0, 0xFF),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "truncated pointer",
+			msg:  append(header, 0xC0),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "label past the end",
+			msg:  append(header, 5, 'a', 'b'),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "missing root label",
+			msg:  append(header, 1, 'a'),
+			off:  headerLen,
+			err:  true,
+		},
+		{
+			name: "reserved label type",
+			msg:  append(header, 0x40, 0),
+			off:  headerLen,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, end, err := readName(test.msg, test.off)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != test.expected || end != test.end {
+				t.Fatalf("expected %q ending at %d, got %q ending at %d", test.expected, test.end, name, end)
+			}
+		})
+	}
+}
+
+func TestParseQueryTruncated(t *testing.T) {
+	msg := buildQuery("app.example.com", typeA, 1232)
+	// every prefix of a valid query is malformed
+	for length := 0; length < len(msg); length++ {
+		if _, err := parseQuery(msg[:length]); err == nil {
+			t.Fatalf("expected a query truncated to %d bytes to be malformed", length)
+		}
+	}
+	if _, err := parseQuery(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseQueryEDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		ednsSize int
+		edns     bool
+		udpSize  int
+	}{
+		{name: "no OPT record", ednsSize: 0, edns: false, udpSize: maxUDPSize},
+		{name: "advertised size", ednsSize: 1232, edns: true, udpSize: 1232},
+		{name: "size below 512", ednsSize: 100, edns: true, udpSize: maxUDPSize},
+		{name: "size above 4096", ednsSize: 65000, edns: true, udpSize: maxEDNSUDPSize},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseQuery(buildQuery("app.example.com", typeA, test.ednsSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.edns != test.edns || q.udpSize != test.udpSize {
+				t.Fatalf("expected edns=%v udpSize=%d, got edns=%v udpSize=%d", test.edns, test.udpSize, q.edns, q.udpSize)
+			}
+			if q.question.name != "app.example.com." || q.question.qtype != typeA {
+				t.Fatalf("unexpected question %+v", q.question)
+			}
+		})
+	}
+}
+
+func TestResponseTruncation(t *testing.T) {
+	q, err := parseQuery(buildQuery("app.example.com", typeTXT, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer []resourceRecord
+	for i := 0; i < 10; i++ {
+		data, _ := rdata(typeTXT, strings.Repeat("x", 100))
+		answer = append(answer, resourceRecord{name: "app.example.com.", rtype: typeTXT, ttl: 60, data: data})
+	}
+
+	resp := parseResponse(t, response(q, 0, rcodeSuccess, answer, nil, maxUDPSize))
+	if !resp.truncated() || len(resp.answer) != 0 {
+		t.Fatalf("expected an empty truncated response, got %d answers truncated=%v", len(resp.answer), resp.truncated())
+	}
+
+	resp = parseResponse(t, response(q, 0, rcodeSuccess, answer, nil, 0))
+	if resp.truncated() || len(resp.answer) != 10 {
+		t.Fatalf("expected 10 answers without a limit, got %d truncated=%v", len(resp.answer), resp.truncated())
+	}
+}
+
+func TestValidName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "app.example.com", valid: true},
+		{name: "app.example.com.", valid: true},
+		{name: label63 + ".example.com", valid: true},
+		// 3*64+61 bytes of labels plus the root label
+		{name: strings.Repeat(label63+".", 3) + strings.Repeat("b", 61), valid: true},
+		{name: strings.Repeat(label63+".", 3) + strings.Repeat("b", 62), valid: false},
+		{name: label63 + "a.example.com", valid: false},
+		{name: "a..example.com", valid: false},
+		{name: ".example.com", valid: false},
+		{name: ".", valid: false},
+		{name: "", valid: false},
+	}
+
+	for _, test := range tests {
+		if valid := validName(test.name); valid != test.valid {
+			t.Errorf("expected validName(%q) to be %v", test.name, test.valid)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package embedded
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ProviderName is the GlobalDNS ProviderName that selects this server
+	ProviderName = "embedded"
+
+	soaTTL     = 300
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+	// soaMinimum is the TTL for negative answers
+	soaMinimum = 60
+
+	maxCNAMEChain = 8
+	tcpTimeout    = 10 * time.Second
+)
+
+// Server is an authoritative DNS server for the root domains of GlobalDNSs
+// whose ProviderName is ProviderName. It implements providers.Provider so
+// records are programmed the same way as for an external DNS service.
+type Server struct {
+	// nameserver is the name this server is reachable under, used in the
+	// SOA and NS records of every zone. It must resolve outside the served
+	// zones since no glue is served for it.
+	nameserver string
+
+	lock    sync.RWMutex
+	zones   map[string]bool
+	records map[string]map[uint16]providers.Record
+	serial  uint32
+}
+
+func NewServer(nameserver string) *Server {
+	return &Server{
+		nameserver: nameserver,
+		zones:      map[string]bool{},
+		records:    map[string]map[uint16]providers.Record{},
+		serial:     uint32(time.Now().Unix()),
+	}
+}
+
+// SetZones replaces the set of zones the server is authoritative for.
+func (s *Server) SetZones(zones []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	newZones := map[string]bool{}
+	for _, zone := range zones {
+		if zone != "" {
+			newZones[providers.Fqdn(zone)] = true
+		}
+	}
+	if len(newZones) != len(s.zones) {
+		s.bumpSerial()
+	} else {
+		for zone := range newZones {
+			if !s.zones[zone] {
+				s.bumpSerial()
+				break
+			}
+		}
+	}
+	s.zones = newZones
+}
+
+func (s *Server) Records(zone string) ([]providers.Record, error) {
+	zone = providers.Fqdn(zone)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var result []providers.Record
+	for name, byType := range s.records {
+		if !inZone(name, zone) {
+			continue
+		}
+		for _, record := range byType {
+			result = append(result, record)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Type < result[j].Type
+	})
+	return result, nil
+}
+
+func (s *Server) ApplyChanges(zone string, changes []providers.Change) error {
+	zone = providers.Fqdn(zone)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, change := range changes {
+		if !inZone(providers.Fqdn(change.Record.Name), zone) {
+			return fmt.Errorf("embedded dns: %s is not in zone %s", change.Record.Name, zone)
+		}
+		if change.Action == providers.ActionDelete {
+			continue
+		}
+		if err := validate(change.Record); err != nil {
+			return err
+		}
+		if _, ok := s.records[providers.Fqdn(change.Record.Name)][typeValues[change.Record.Type]]; ok && change.Action == providers.ActionCreate {
+			return fmt.Errorf("embedded dns: %s %s already exists", change.Record.Type, change.Record.Name)
+		}
+	}
+
+	for _, change := range changes {
+		record := change.Record
+		record.Name = providers.Fqdn(record.Name)
+		rtype, ok := typeValues[record.Type]
+		if !ok {
+			logrus.Warnf("embedded dns: ignoring unsupported record type %s for %s", record.Type, record.Name)
+			continue
+		}
+
+		byType := s.records[record.Name]
+		switch change.Action {
+		case providers.ActionUpsert, providers.ActionCreate:
+			if byType == nil {
+				byType = map[uint16]providers.Record{}
+				s.records[record.Name] = byType
+			}
+			byType[rtype] = record
+		case providers.ActionDelete:
+			delete(byType, rtype)
+			if len(byType) == 0 {
+				delete(s.records, record.Name)
+			}
+		}
+	}
+	s.bumpSerial()
+	return nil
+}
+
+// Start listens on addr over UDP and TCP and serves queries until ctx is
+// done.
+func (s *Server) Start(ctx context.Context, addr string) error {
+	if !validName(s.nameserver) {
+		return fmt.Errorf("embedded dns: invalid nameserver name %q", s.nameserver)
+	}
+
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		// the listen error is the one worth reporting
+		_ = udp.Close()
+		return err
+	}
+
+	// the serve loops stop once ctx is done, so the errors from closing are
+	// expected
+	go func() {
+		<-ctx.Done()
+		_ = udp.Close()
+		_ = tcp.Close()
+	}()
+	go s.serveUDP(ctx, udp)
+	go s.serveTCP(ctx, tcp)
+	return nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Debugf("embedded dns: udp read: %v", err)
+			continue
+		}
+		if resp := s.handle(buf[:n], true); resp != nil {
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				logrus.Debugf("embedded dns: udp write to %s: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Debugf("embedded dns: tcp accept: %v", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := conn.SetDeadline(time.Now().Add(tcpTimeout)); err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		resp := s.handle(msg, false)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(append(appendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a single query. It returns nil if the message is not worth
+// a reply.
+func (s *Server) handle(msg []byte, udp bool) []byte {
+	q, err := parseQuery(msg)
+	if q == nil || q.header.flags&(1<<15) != 0 {
+		return nil
+	}
+	limit := 0
+	if udp {
+		limit = q.udpSize
+	}
+	if err != nil {
+		q.question = question{name: "."}
+		q.edns = false
+		return response(q, 0, rcodeFormatError, nil, nil, limit)
+	}
+	if opcode := (q.header.flags >> 11) & 0xF; opcode != 0 {
+		return response(q, 0, rcodeNotImplemented, nil, nil, limit)
+	}
+
+	rcode, answer, authority := s.answer(q.question)
+	flags := uint16(0)
+	if rcode != rcodeRefused {
+		flags |= 1 << 10 // AA
+	}
+	return response(q, flags, rcode, answer, authority, limit)
+}
+
+func (s *Server) answer(question question) (int, []resourceRecord, []resourceRecord) {
+	if question.class != classINET && question.class != classANY {
+		return rcodeRefused, nil, nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	name := strings.ToLower(question.name)
+	zone := s.zoneFor(name)
+	if zone == "" {
+		return rcodeRefused, nil, nil
+	}
+	negative := []resourceRecord{s.soa(zone, soaMinimum)}
+
+	byType, ok := s.lookup(name, zone)
+	if !ok {
+		if s.exists(name) {
+			return rcodeSuccess, nil, negative
+		}
+		return rcodeNameError, nil, negative
+	}
+
+	var answer []resourceRecord
+	owner := question.name
+	for hops := 0; hops < maxCNAMEChain; hops++ {
+		cname, isAlias := byType[typeCNAME]
+		if isAlias && len(cname.Targets) > 0 && question.qtype != typeCNAME && question.qtype != typeANY {
+			answer = append(answer, s.resourceRecords(owner, typeCNAME, cname)...)
+			owner = providers.Fqdn(cname.Targets[0])
+			target := strings.ToLower(owner)
+			if byType, ok = s.lookup(target, s.zoneFor(target)); !ok {
+				break
+			}
+			continue
+		}
+
+		if question.qtype == typeANY {
+			for rtype, record := range byType {
+				answer = append(answer, s.resourceRecords(owner, rtype, record)...)
+			}
+		} else if record, ok := byType[question.qtype]; ok {
+			answer = append(answer, s.resourceRecords(owner, question.qtype, record)...)
+		}
+		if strings.ToLower(owner) == s.zoneFor(strings.ToLower(owner)) {
+			answer = append(answer, s.apexRecords(owner, question.qtype)...)
+		}
+		break
+	}
+
+	if len(answer) == 0 {
+		return rcodeSuccess, nil, negative
+	}
+	return rcodeSuccess, answer, nil
+}
+
+// lookup returns the records for name, falling back to a wildcard at the
+// closest existing ancestor. ok is false if nothing matches.
+func (s *Server) lookup(name, zone string) (map[uint16]providers.Record, bool) {
+	if zone == "" {
+		return nil, false
+	}
+	if byType, ok := s.records[name]; ok {
+		return byType, true
+	}
+	if name == zone {
+		return map[uint16]providers.Record{}, true
+	}
+	if s.exists(name) {
+		return nil, false
+	}
+
+	for encloser := parent(name); inZone(encloser, zone); encloser = parent(encloser) {
+		if byType, ok := s.records["*."+encloser]; ok {
+			return byType, true
+		}
+		if encloser == zone || s.exists(encloser) {
+			break
+		}
+	}
+	return nil, false
+}
+
+// exists reports whether name has records or is an empty non-terminal.
+func (s *Server) exists(name string) bool {
+	if _, ok := s.records[name]; ok || s.zones[name] {
+		return true
+	}
+	for other := range s.records {
+		if strings.HasSuffix(other, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) zoneFor(name string) string {
+	zone := ""
+	for z := range s.zones {
+		if inZone(name, z) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+func (s *Server) apexRecords(owner string, qtype uint16) []resourceRecord {
+	zone := strings.ToLower(owner)
+	var result []resourceRecord
+	if qtype == typeSOA || qtype == typeANY {
+		soa := s.soa(zone, soaTTL)
+		soa.name = owner
+		result = append(result, soa)
+	}
+	if qtype == typeNS || qtype == typeANY {
+		data, _ := rdata(typeNS, providers.Fqdn(s.nameserver))
+		result = append(result, resourceRecord{name: owner, rtype: typeNS, ttl: soaTTL, data: data})
+	}
+	return result
+}
+
+func (s *Server) soa(zone string, ttl uint32) resourceRecord {
+	return resourceRecord{
+		name:  zone,
+		rtype: typeSOA,
+		ttl:   ttl,
+		data:  soaData(providers.Fqdn(s.nameserver), "hostmaster."+zone, s.serial, soaRefresh, soaRetry, soaExpire, soaMinimum),
+	}
+}
+
+func (s *Server) resourceRecords(owner string, rtype uint16, record providers.Record) []resourceRecord {
+	var result []resourceRecord
+	for _, target := range record.Targets {
+		data, ok := rdata(rtype, target)
+		if !ok {
+			continue
+		}
+		result = append(result, resourceRecord{
+			name:  owner,
+			rtype: rtype,
+			ttl:   uint32(record.TTL),
+			data:  data,
+		})
+	}
+	return result
+}
+
+func (s *Server) bumpSerial() {
+	serial := uint32(time.Now().Unix())
+	if serial <= s.serial {
+		serial = s.serial + 1
+	}
+	s.serial = serial
+}
+
+// validate rejects records that could not be served, so answers never have
+// to deal with a record without targets.
+func validate(record providers.Record) error {
+	rtype, ok := typeValues[record.Type]
+	if !ok {
+		// unsupported types are skipped when applied
+		return nil
+	}
+	if len(record.Targets) == 0 {
+		return fmt.Errorf("embedded dns: %s %s has no targets", record.Type, record.Name)
+	}
+	for _, target := range record.Targets {
+		if _, ok := rdata(rtype, target); !ok {
+			return fmt.Errorf("embedded dns: invalid %s target %q for %s", record.Type, target, record.Name)
+		}
+	}
+	if rtype == typeCNAME && len(record.Targets) != 1 {
+		return fmt.Errorf("embedded dns: CNAME %s must have exactly one target", record.Name)
+	}
+	return nil
+}
+
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func parent(name string) string {
+	if i := strings.Index(name, "."); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return "."
+}
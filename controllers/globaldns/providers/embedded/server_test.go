@@ -0,0 +1,303 @@
+package embedded
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+)
+
+func newTestServer(t *testing.T, records ...providers.Record) *Server {
+	s := NewServer("ns1.dns.test")
+	s.SetZones([]string{"example.com"})
+
+	var changes []providers.Change
+	for _, record := range records {
+		changes = append(changes, providers.Change{Action: providers.ActionUpsert, Record: record})
+	}
+	if err := s.ApplyChanges("example.com", changes); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func record(name, rtype string, targets ...string) providers.Record {
+	return providers.Record{Name: name, Type: rtype, TTL: 30, Targets: targets}
+}
+
+func TestHandle(t *testing.T) {
+	s := newTestServer(t,
+		record("app.example.com", "A", "1.1.1.1", "2.2.2.2"),
+		record("app.example.com", "AAAA", "2001:db8::1"),
+		record("www.example.com", "CNAME", "app.example.com"),
+		record("chain.example.com", "CNAME", "www.example.com"),
+		record("external.example.com", "CNAME", "app.example.org"),
+		record("loop1.example.com", "CNAME", "loop2.example.com"),
+		record("loop2.example.com", "CNAME", "loop1.example.com"),
+		record("*.apps.example.com", "A", "3.3.3.3"),
+		record("real.apps.example.com", "TXT", "real"),
+		record("a.b.example.com", "A", "4.4.4.4"),
+	)
+	negative := "example.com. 60 SOA ns1.dns.test. minimum=60"
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answer    []string
+		authority []string
+	}{
+		{
+			name:   "A records",
+			qname:  "app.example.com",
+			qtype:  typeA,
+			answer: []string{"app.example.com. 30 A 1.1.1.1", "app.example.com. 30 A 2.2.2.2"},
+		},
+		{
+			name:   "owner keeps the case of the question",
+			qname:  "App.EXAMPLE.com",
+			qtype:  typeAAAA,
+			answer: []string{"App.EXAMPLE.com. 30 AAAA 2001:db8::1"},
+		},
+		{
+			name:      "NODATA for a missing type",
+			qname:     "app.example.com",
+			qtype:     typeTXT,
+			authority: []string{negative},
+		},
+		{
+			name:      "NODATA for an empty non-terminal",
+			qname:     "b.example.com",
+			qtype:     typeA,
+			authority: []string{negative},
+		},
+		{
+			name:      "NXDOMAIN for a missing name",
+			qname:     "missing.example.com",
+			qtype:     typeA,
+			rcode:     rcodeNameError,
+			authority: []string{negative},
+		},
+		{
+			name:   "wildcard",
+			qname:  "x.apps.example.com",
+			qtype:  typeA,
+			answer: []string{"x.apps.example.com. 30 A 3.3.3.3"},
+		},
+		{
+			name:   "wildcard below a missing name",
+			qname:  "y.x.apps.example.com",
+			qtype:  typeA,
+			answer: []string{"y.x.apps.example.com. 30 A 3.3.3.3"},
+		},
+		{
+			name:      "existing name is not covered by the wildcard",
+			qname:     "real.apps.example.com",
+			qtype:     typeA,
+			authority: []string{negative},
+		},
+		{
+			name:      "wildcard does not apply below an existing name",
+			qname:     "x.real.apps.example.com",
+			qtype:     typeA,
+			rcode:     rcodeNameError,
+			authority: []string{negative},
+		},
+		{
+			name:  "CNAME is chased within the zone",
+			qname: "chain.example.com",
+			qtype: typeA,
+			answer: []string{
+				"chain.example.com. 30 CNAME www.example.com.",
+				"www.example.com. 30 CNAME app.example.com.",
+				"app.example.com. 30 A 1.1.1.1",
+				"app.example.com. 30 A 2.2.2.2",
+			},
+		},
+		{
+			name:   "CNAME query is not chased",
+			qname:  "www.example.com",
+			qtype:  typeCNAME,
+			answer: []string{"www.example.com. 30 CNAME app.example.com."},
+		},
+		{
+			name:   "CNAME out of the zone",
+			qname:  "external.example.com",
+			qtype:  typeA,
+			answer: []string{"external.example.com. 30 CNAME app.example.org."},
+		},
+		{
+			name:  "CNAME loop is bounded",
+			qname: "loop1.example.com",
+			qtype: typeA,
+			answer: []string{
+				"loop1.example.com. 30 CNAME loop2.example.com.",
+				"loop2.example.com. 30 CNAME loop1.example.com.",
+				"loop1.example.com. 30 CNAME loop2.example.com.",
+				"loop2.example.com. 30 CNAME loop1.example.com.",
+				"loop1.example.com. 30 CNAME loop2.example.com.",
+				"loop2.example.com. 30 CNAME loop1.example.com.",
+				"loop1.example.com. 30 CNAME loop2.example.com.",
+				"loop2.example.com. 30 CNAME loop1.example.com.",
+			},
+		},
+		{
+			name:   "apex NS",
+			qname:  "example.com",
+			qtype:  typeNS,
+			answer: []string{"example.com. 300 NS ns1.dns.test."},
+		},
+		{
+			name:   "apex SOA",
+			qname:  "example.com",
+			qtype:  typeSOA,
+			answer: []string{"example.com. 300 SOA ns1.dns.test. minimum=60"},
+		},
+		{
+			name:  "outside of the zones",
+			qname: "example.org",
+			qtype: typeA,
+			rcode: rcodeRefused,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := parseResponse(t, s.handle(buildQuery(test.qname, test.qtype, 0), true))
+			if resp.rcode != test.rcode {
+				t.Fatalf("expected rcode %d, got %d", test.rcode, resp.rcode)
+			}
+			if resp.authoritative() != (test.rcode != rcodeRefused) {
+				t.Fatalf("unexpected AA bit in flags %x", resp.flags)
+			}
+			if strings.Join(resp.answer, "\n") != strings.Join(test.answer, "\n") {
+				t.Fatalf("expected answer\n%s\ngot\n%s", strings.Join(test.answer, "\n"), strings.Join(resp.answer, "\n"))
+			}
+			if strings.Join(resp.authority, "\n") != strings.Join(test.authority, "\n") {
+				t.Fatalf("expected authority\n%s\ngot\n%s", strings.Join(test.authority, "\n"), strings.Join(resp.authority, "\n"))
+			}
+		})
+	}
+}
+
+func TestHandleTruncation(t *testing.T) {
+	var targets []string
+	for i := 0; i < 10; i++ {
+		targets = append(targets, strings.Repeat(string(rune('a'+i)), 100))
+	}
+	s := newTestServer(t, record("big.example.com", "TXT", targets...))
+
+	tests := []struct {
+		name      string
+		udp       bool
+		ednsSize  int
+		truncated bool
+	}{
+		{name: "UDP without EDNS", udp: true, truncated: true},
+		{name: "UDP with a small EDNS size", udp: true, ednsSize: 1000, truncated: true},
+		{name: "UDP with a large EDNS size", udp: true, ednsSize: 4096},
+		{name: "TCP", udp: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := parseResponse(t, s.handle(buildQuery("big.example.com", typeTXT, test.ednsSize), test.udp))
+			if resp.truncated() != test.truncated {
+				t.Fatalf("expected truncated=%v, got flags %x", test.truncated, resp.flags)
+			}
+			if test.truncated && len(resp.answer) != 0 || !test.truncated && len(resp.answer) != 10 {
+				t.Fatalf("unexpected %d answers", len(resp.answer))
+			}
+			if resp.edns != (test.ednsSize > 0) {
+				t.Fatalf("expected OPT record=%v", test.ednsSize > 0)
+			}
+		})
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := parseResponse(t, s.handle([]byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12}, true))
+	if resp.rcode != rcodeFormatError {
+		t.Fatalf("expected FORMERR for a pointer loop, got rcode %d", resp.rcode)
+	}
+	if msg := s.handle([]byte{0x12, 0x34}, true); msg != nil {
+		t.Fatalf("expected no reply to a message shorter than a header, got %x", msg)
+	}
+
+	reply := buildQuery("app.example.com", typeA, 0)
+	reply[2] |= 0x80 // QR
+	if msg := s.handle(reply, true); msg != nil {
+		t.Fatalf("expected no reply to a response, got %x", msg)
+	}
+}
+
+func TestApplyChangesRejectsInvalidRecords(t *testing.T) {
+	s := newTestServer(t, record("app.example.com", "A", "1.1.1.1"))
+
+	tests := []struct {
+		name   string
+		record providers.Record
+	}{
+		{name: "CNAME without targets", record: record("www.example.com", "CNAME")},
+		{name: "CNAME with two targets", record: record("www.example.com", "CNAME", "a.example.com", "b.example.com")},
+		{name: "A without targets", record: record("www.example.com", "A")},
+		{name: "A with an IPv6 target", record: record("www.example.com", "A", "2001:db8::1")},
+		{name: "AAAA with an IPv4 target", record: record("www.example.com", "AAAA", "1.1.1.1")},
+		{name: "SOA record", record: record("example.com", "SOA", "ns.example.com")},
+		{name: "name outside of the zone", record: record("app.example.org", "A", "2.2.2.2")},
+		{name: "name sharing a suffix with the zone", record: record("app.notexample.com", "A", "2.2.2.2")},
+		{name: "CNAME with an empty label", record: record("www.example.com", "CNAME", "a..example.org")},
+		{name: "CNAME to the root", record: record("www.example.com", "CNAME", ".")},
+		{name: "CNAME with a label over 63 bytes", record: record("www.example.com", "CNAME", strings.Repeat("a", 64)+".example.org")},
+		{name: "CNAME over 255 bytes", record: record("www.example.com", "CNAME", strings.Repeat(strings.Repeat("a", 63)+".", 4)+"org")},
+		{name: "NS with an empty label", record: record("sub.example.com", "NS", ".sub.example.org")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := []providers.Change{
+				{Action: providers.ActionUpsert, Record: record("app.example.com", "A", "2.2.2.2")},
+				{Action: providers.ActionUpsert, Record: test.record},
+			}
+			if err := s.ApplyChanges("example.com", changes); err == nil {
+				t.Fatal("expected the change to be rejected")
+			}
+
+			// nothing from the batch was applied
+			resp := parseResponse(t, s.handle(buildQuery("app.example.com", typeA, 0), true))
+			if len(resp.answer) != 1 || resp.answer[0] != "app.example.com. 30 A 1.1.1.1" {
+				t.Fatalf("expected the existing record to be unchanged, got %v", resp.answer)
+			}
+			resp = parseResponse(t, s.handle(buildQuery(test.record.Name, typeA, 0), true))
+			if test.record.Type != "SOA" && resp.rcode != rcodeNameError && resp.rcode != rcodeRefused {
+				t.Fatalf("expected %s to not exist, got rcode %d", test.record.Name, resp.rcode)
+			}
+			if byType, ok := s.records[providers.Fqdn(test.record.Name)]; ok {
+				t.Fatalf("expected no records for %s, got %v", test.record.Name, byType)
+			}
+		})
+	}
+}
+
+func TestApplyChangesCreateFailsIfExists(t *testing.T) {
+	s := newTestServer(t, record("app.example.com", "A", "1.1.1.1"))
+
+	changes := []providers.Change{{Action: providers.ActionCreate, Record: record("app.example.com", "A", "2.2.2.2")}}
+	if err := s.ApplyChanges("example.com", changes); err == nil {
+		t.Fatal("expected create of an existing record to fail")
+	}
+	records, _ := s.Records("example.com")
+	if len(records) != 1 || records[0].Targets[0] != "1.1.1.1" {
+		t.Fatalf("expected the existing record to be unchanged, got %v", records)
+	}
+}
+
+func TestStartRequiresNameserver(t *testing.T) {
+	if err := NewServer("").Start(context.Background(), "127.0.0.1:0"); err == nil {
+		t.Fatal("expected Start to fail without a nameserver")
+	}
+}
@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"strings"
+)
+
+const (
+	ActionUpsert = "UPSERT"
+	ActionDelete = "DELETE"
+	// ActionCreate fails if the record set already exists
+	ActionCreate = "CREATE"
+)
+
+// Record is a single DNS record set. Name is always a fully qualified name
+// with a trailing dot. Owner is the UID of the GlobalDNS the record belongs
+// to, see Registry.
+type Record struct {
+	Name    string
+	Type    string
+	TTL     int64
+	Targets []string
+	Owner   string
+}
+
+type Change struct {
+	Action string
+	Record Record
+}
+
+// Provider programs record sets in the zones served by a DNS service.
+type Provider interface {
+	Records(zone string) ([]Record, error)
+	ApplyChanges(zone string, changes []Change) error
+}
+
+// Fqdn returns name in lower case with a trailing dot.
+func Fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	return name
+}
@@ -0,0 +1,328 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ownerHeritage = "multi-cluster-app"
+	ownerPrefix   = "_globaldns."
+)
+
+// OwnershipError is returned for changes to records that exist in the zone
+// but were not created by the GlobalDNS making the change.
+type OwnershipError struct {
+	Records []string
+}
+
+func (e *OwnershipError) Error() string {
+	return fmt.Sprintf("refusing to change records not owned by this GlobalDNS: %s", strings.Join(e.Records, ", "))
+}
+
+// Registry wraps a Provider and tracks ownership of every record it writes
+// in a companion TXT record naming the management cluster and the UID of
+// the owning GlobalDNS. Changes to records that are unowned, or owned by
+// another GlobalDNS or management cluster, are refused.
+type Registry struct {
+	Provider  Provider
+	ClusterID string
+
+	lock sync.Mutex
+	// claims holds the names with changes in flight. The channel is closed
+	// when the changes are done.
+	claims map[string]chan struct{}
+	// listings holds the latest listing of each zone, which callers that
+	// claimed their names before it started can share.
+	listings map[string]*listing
+	seq      uint64
+}
+
+type listing struct {
+	seq     uint64
+	done    chan struct{}
+	records []Record
+	owners  map[string]owner
+	err     error
+}
+
+type owner struct {
+	clusterID string
+	uid       string
+	record    Record
+}
+
+// Records returns the records in zone owned by this management cluster,
+// with Owner set to the owning GlobalDNS UID.
+func (r *Registry) Records(zone string) ([]Record, error) {
+	records, owners, err := r.list(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Record
+	for _, record := range records {
+		o, ok := owners[record.Name]
+		if !ok || o.clusterID != r.ClusterID {
+			continue
+		}
+		record.Owner = o.uid
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+// ApplyChanges applies the changes owned by Record.Owner and returns an
+// OwnershipError listing any that were refused. New records and owner TXT
+// records are written with ActionCreate, so a competing claim made by
+// another writer after the zone was listed makes the provider fail the
+// change instead of overwriting it. Calls changing different names run
+// concurrently so providers can batch them.
+func (r *Registry) ApplyChanges(zone string, changes []Change) error {
+	var names []string
+	for _, change := range changes {
+		names = append(names, Fqdn(change.Record.Name))
+	}
+	seq, release := r.claim(names)
+	defer release()
+
+	records, owners, err := r.listAfter(zone, seq)
+	if err != nil {
+		return err
+	}
+	existing := map[string]Record{}
+	remaining := map[string]int{}
+	for _, record := range records {
+		existing[record.Name+"/"+record.Type] = record
+		remaining[record.Name]++
+	}
+
+	var (
+		allowed []Change
+		refused []string
+		touched = map[string]string{}
+	)
+	for _, change := range changes {
+		change.Record.Name = Fqdn(change.Record.Name)
+		name, uid := change.Record.Name, change.Record.Owner
+		current, exists := existing[name+"/"+change.Record.Type]
+		o, owned := owners[name]
+
+		if (exists || owned) && (!owned || o.clusterID != r.ClusterID || o.uid != uid) {
+			refused = append(refused, name+" "+change.Record.Type)
+			continue
+		}
+
+		switch change.Action {
+		case ActionDelete:
+			if !exists {
+				// a previous delete may have failed before removing the owner
+				if owned && remaining[name] == 0 {
+					touched[name] = uid
+				}
+				continue
+			}
+			// delete the record as it is in the zone, some providers require
+			// an exact match
+			change.Record = current
+			remaining[name]--
+		case ActionUpsert, ActionCreate:
+			if !exists {
+				change.Action = ActionCreate
+				remaining[name]++
+			}
+		default:
+			continue
+		}
+		allowed = append(allowed, change)
+		touched[name] = uid
+	}
+
+	// owners are written before and removed after their records, so a
+	// provider failing partway never leaves a record without an owner
+	var claimed, released []Change
+	for _, name := range sortedKeys(touched) {
+		o, owned := owners[name]
+		switch {
+		case remaining[name] > 0 && owned:
+			claimed = append(claimed, Change{Action: ActionUpsert, Record: r.ownerRecord(name, touched[name])})
+		case remaining[name] > 0:
+			claimed = append(claimed, Change{Action: ActionCreate, Record: r.ownerRecord(name, touched[name])})
+		case owned:
+			released = append(released, Change{Action: ActionDelete, Record: o.record})
+		}
+	}
+	if allowed = append(append(claimed, allowed...), released...); len(allowed) > 0 {
+		if err := r.Provider.ApplyChanges(zone, allowed); err != nil {
+			return err
+		}
+	}
+	if len(refused) > 0 {
+		return &OwnershipError{Records: refused}
+	}
+	return nil
+}
+
+// claim waits until none of names have changes in flight and claims them
+// all. It returns a sequence number ordering the claim against listings,
+// and a func releasing the claim.
+func (r *Registry) claim(names []string) (uint64, func()) {
+	r.lock.Lock()
+	for {
+		var busy chan struct{}
+		for _, name := range names {
+			if ch, ok := r.claims[name]; ok {
+				busy = ch
+				break
+			}
+		}
+		if busy == nil {
+			break
+		}
+		r.lock.Unlock()
+		<-busy
+		r.lock.Lock()
+	}
+	defer r.lock.Unlock()
+
+	if r.claims == nil {
+		r.claims = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	for _, name := range names {
+		r.claims[name] = done
+	}
+	r.seq++
+	return r.seq, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for _, name := range names {
+			delete(r.claims, name)
+		}
+		close(done)
+	}
+}
+
+// listAfter lists zone, sharing a listing with concurrent callers as long
+// as it started after the claim numbered seq, so it includes every change
+// made to the claimed names before.
+func (r *Registry) listAfter(zone string, seq uint64) ([]Record, map[string]owner, error) {
+	zone = Fqdn(zone)
+
+	r.lock.Lock()
+	l, ok := r.listings[zone]
+	if !ok || l.seq < seq {
+		if r.listings == nil {
+			r.listings = map[string]*listing{}
+		}
+		r.seq++
+		l = &listing{seq: r.seq, done: make(chan struct{})}
+		r.listings[zone] = l
+		r.lock.Unlock()
+
+		l.records, l.owners, l.err = r.list(zone)
+		close(l.done)
+	} else {
+		r.lock.Unlock()
+		<-l.done
+	}
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+
+	// callers change the records they get, so each gets its own copy
+	records := append([]Record(nil), l.records...)
+	owners := make(map[string]owner, len(l.owners))
+	for name, o := range l.owners {
+		owners[name] = o
+	}
+	return records, owners, nil
+}
+
+// list splits the records in zone into regular records and the ownership
+// recorded in companion TXT records, keyed by the name they refer to.
+func (r *Registry) list(zone string) ([]Record, map[string]owner, error) {
+	all, err := r.Provider.Records(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []Record
+	owners := map[string]owner{}
+	for _, record := range all {
+		record.Name = Fqdn(record.Name)
+		if record.Type == "TXT" && strings.HasPrefix(record.Name, ownerPrefix) {
+			if o, ok := parseOwner(record); ok {
+				owners[ownedName(record.Name)] = o
+				continue
+			}
+		}
+		if record.Type == "SOA" || record.Type == "NS" {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, owners, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *Registry) ownerRecord(name, uid string) Record {
+	return Record{
+		Name:    ownerName(name),
+		Type:    "TXT",
+		TTL:     300,
+		Targets: []string{fmt.Sprintf("heritage=%s,cluster=%s,globaldns=%s", ownerHeritage, r.ClusterID, uid)},
+		Owner:   uid,
+	}
+}
+
+func parseOwner(record Record) (owner, bool) {
+	if len(record.Targets) != 1 {
+		return owner{}, false
+	}
+	o := owner{record: record}
+	heritage := false
+	for _, field := range strings.Split(strings.Trim(record.Targets[0], `"`), ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "heritage":
+			heritage = kv[1] == ownerHeritage
+		case "cluster":
+			o.clusterID = kv[1]
+		case "globaldns":
+			o.uid = kv[1]
+		}
+	}
+	return o, heritage
+}
+
+// ownerName returns the name of the companion TXT record for name. A
+// leading wildcard label is replaced since the TXT record must not match
+// other names itself.
+func ownerName(name string) string {
+	if strings.HasPrefix(name, "*.") {
+		name = "_wildcard." + strings.TrimPrefix(name, "*.")
+	}
+	return ownerPrefix + name
+}
+
+func ownedName(name string) string {
+	name = strings.TrimPrefix(name, ownerPrefix)
+	if strings.HasPrefix(name, "_wildcard.") {
+		name = "*." + strings.TrimPrefix(name, "_wildcard.")
+	}
+	return name
+}
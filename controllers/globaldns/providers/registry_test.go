@@ -0,0 +1,340 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeProvider keeps records in memory and, like Route53, rejects a whole
+// batch if a CREATE targets an existing record set. beforeApply runs after
+// the zone has been listed, to simulate a concurrent writer. If failAt is
+// set, changes are applied one at a time like Cloudflare and the change at
+// that position fails once.
+type fakeProvider struct {
+	records     map[string]Record
+	beforeApply func(f *fakeProvider)
+	failAt      int
+}
+
+func newFakeProvider(records ...Record) *fakeProvider {
+	f := &fakeProvider{records: map[string]Record{}}
+	for _, record := range records {
+		f.put(record)
+	}
+	return f
+}
+
+func (f *fakeProvider) put(record Record) {
+	record.Name = Fqdn(record.Name)
+	record.Owner = ""
+	f.records[record.Name+"/"+record.Type] = record
+}
+
+func (f *fakeProvider) Records(zone string) ([]Record, error) {
+	var result []Record
+	for _, record := range f.records {
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+func (f *fakeProvider) ApplyChanges(zone string, changes []Change) error {
+	if f.beforeApply != nil {
+		f.beforeApply(f)
+	}
+	if f.failAt > 0 {
+		for i, change := range changes {
+			if i+1 == f.failAt {
+				f.failAt = 0
+				return fmt.Errorf("failed to apply %s %s", change.Record.Name, change.Record.Type)
+			}
+			f.apply(change)
+		}
+		return nil
+	}
+	for _, change := range changes {
+		if _, ok := f.records[Fqdn(change.Record.Name)+"/"+change.Record.Type]; ok && change.Action == ActionCreate {
+			return fmt.Errorf("%s %s already exists", change.Record.Name, change.Record.Type)
+		}
+	}
+	for _, change := range changes {
+		f.apply(change)
+	}
+	return nil
+}
+
+func (f *fakeProvider) apply(change Change) {
+	if change.Action == ActionDelete {
+		delete(f.records, Fqdn(change.Record.Name)+"/"+change.Record.Type)
+	} else {
+		f.put(change.Record)
+	}
+}
+
+func (f *fakeProvider) dump() []string {
+	var result []string
+	for _, record := range f.records {
+		result = append(result, fmt.Sprintf("%s %s %s", record.Name, record.Type, strings.Join(record.Targets, ",")))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func a(name, ip, owner string) Record {
+	return Record{Name: name, Type: "A", TTL: 60, Targets: []string{ip}, Owner: owner}
+}
+
+func ownerTXT(name, cluster, uid string) Record {
+	return Record{
+		Name:    name,
+		Type:    "TXT",
+		TTL:     300,
+		Targets: []string{"heritage=multi-cluster-app,cluster=" + cluster + ",globaldns=" + uid},
+	}
+}
+
+func TestRegistryApplyChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []Record
+		changes  []Change
+		refused  bool
+		expected []string
+	}{
+		{
+			name:    "new record gets an owner",
+			changes: []Change{{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")}},
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1",
+				"app.example.com. A 1.1.1.1",
+			},
+		},
+		{
+			name: "owned record is updated",
+			existing: []Record{
+				a("app.example.com", "1.1.1.1", ""),
+				ownerTXT("_globaldns.app.example.com", "local", "uid1"),
+			},
+			changes: []Change{{Action: ActionUpsert, Record: a("app.example.com", "2.2.2.2", "uid1")}},
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1",
+				"app.example.com. A 2.2.2.2",
+			},
+		},
+		{
+			name:     "unowned existing record is refused",
+			existing: []Record{a("app.example.com", "9.9.9.9", "")},
+			changes:  []Change{{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")}},
+			refused:  true,
+			expected: []string{"app.example.com. A 9.9.9.9"},
+		},
+		{
+			name: "record owned by another cluster is refused",
+			existing: []Record{
+				a("app.example.com", "9.9.9.9", ""),
+				ownerTXT("_globaldns.app.example.com", "other", "uid1"),
+			},
+			changes: []Change{{Action: ActionDelete, Record: a("app.example.com", "", "uid1")}},
+			refused: true,
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=other,globaldns=uid1",
+				"app.example.com. A 9.9.9.9",
+			},
+		},
+		{
+			name: "record owned by another GlobalDNS is refused",
+			existing: []Record{
+				a("app.example.com", "9.9.9.9", ""),
+				ownerTXT("_globaldns.app.example.com", "local", "uid2"),
+			},
+			changes: []Change{{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")}},
+			refused: true,
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid2",
+				"app.example.com. A 9.9.9.9",
+			},
+		},
+		{
+			name: "name claimed by another GlobalDNS is refused for a new type",
+			existing: []Record{
+				ownerTXT("_globaldns.app.example.com", "local", "uid2"),
+			},
+			changes: []Change{{Action: ActionUpsert, Record: Record{Name: "app.example.com", Type: "AAAA", Targets: []string{"::1"}, Owner: "uid1"}}},
+			refused: true,
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid2",
+			},
+		},
+		{
+			name:    "wildcard owner uses the _wildcard label",
+			changes: []Change{{Action: ActionUpsert, Record: a("*.app.example.com", "1.1.1.1", "uid1")}},
+			expected: []string{
+				"*.app.example.com. A 1.1.1.1",
+				"_globaldns._wildcard.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1",
+			},
+		},
+		{
+			name: "wildcard owned by another GlobalDNS is refused",
+			existing: []Record{
+				a("*.app.example.com", "9.9.9.9", ""),
+				ownerTXT("_globaldns._wildcard.app.example.com", "local", "uid2"),
+			},
+			changes: []Change{{Action: ActionUpsert, Record: a("*.app.example.com", "1.1.1.1", "uid1")}},
+			refused: true,
+			expected: []string{
+				"*.app.example.com. A 9.9.9.9",
+				"_globaldns._wildcard.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid2",
+			},
+		},
+		{
+			name: "deleting one of two types keeps the owner",
+			existing: []Record{
+				a("app.example.com", "1.1.1.1", ""),
+				{Name: "app.example.com", Type: "AAAA", Targets: []string{"::1"}},
+				ownerTXT("_globaldns.app.example.com", "local", "uid1"),
+			},
+			changes: []Change{{Action: ActionDelete, Record: a("app.example.com", "", "uid1")}},
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1",
+				"app.example.com. AAAA ::1",
+			},
+		},
+		{
+			name: "deleting the last record removes the owner",
+			existing: []Record{
+				a("app.example.com", "1.1.1.1", ""),
+				ownerTXT("_globaldns.app.example.com", "local", "uid1"),
+			},
+			changes:  []Change{{Action: ActionDelete, Record: a("app.example.com", "", "uid1")}},
+			expected: nil,
+		},
+		{
+			name: "allowed changes are applied alongside refused ones",
+			existing: []Record{
+				a("manual.example.com", "9.9.9.9", ""),
+			},
+			changes: []Change{
+				{Action: ActionUpsert, Record: a("manual.example.com", "1.1.1.1", "uid1")},
+				{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")},
+			},
+			refused: true,
+			expected: []string{
+				"_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1",
+				"app.example.com. A 1.1.1.1",
+				"manual.example.com. A 9.9.9.9",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider(test.existing...)
+			registry := &Registry{Provider: provider, ClusterID: "local"}
+
+			err := registry.ApplyChanges("example.com", test.changes)
+			if _, isOwnership := err.(*OwnershipError); test.refused != isOwnership {
+				t.Fatalf("expected refused=%v, got error %v", test.refused, err)
+			}
+			if !test.refused && err != nil {
+				t.Fatal(err)
+			}
+			if got := provider.dump(); strings.Join(got, "\n") != strings.Join(test.expected, "\n") {
+				t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(test.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestRegistryCompetingClaim(t *testing.T) {
+	provider := newFakeProvider()
+	// another writer claims the name after the registry listed the zone
+	provider.beforeApply = func(f *fakeProvider) {
+		f.beforeApply = nil
+		f.put(ownerTXT("_globaldns.app.example.com", "other", "uid2"))
+	}
+	registry := &Registry{Provider: provider, ClusterID: "local"}
+
+	err := registry.ApplyChanges("example.com", []Change{{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")}})
+	if err == nil {
+		t.Fatal("expected the competing claim to fail the change")
+	}
+	expected := "_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=other,globaldns=uid2"
+	if got := provider.dump(); len(got) != 1 || got[0] != expected {
+		t.Fatalf("expected only the competing owner record, got %v", got)
+	}
+}
+
+func TestRegistryPartialFailure(t *testing.T) {
+	owned := "_globaldns.app.example.com. TXT heritage=multi-cluster-app,cluster=local,globaldns=uid1"
+	tests := []struct {
+		name     string
+		existing []Record
+		change   Change
+		// expected is the zone after the change failed at its second step
+		expected []string
+	}{
+		{
+			name:     "create",
+			change:   Change{Action: ActionUpsert, Record: a("app.example.com", "1.1.1.1", "uid1")},
+			expected: []string{owned},
+		},
+		{
+			name: "delete",
+			existing: []Record{
+				a("app.example.com", "1.1.1.1", ""),
+				ownerTXT("_globaldns.app.example.com", "local", "uid1"),
+			},
+			change:   Change{Action: ActionDelete, Record: a("app.example.com", "", "uid1")},
+			expected: []string{owned},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider(test.existing...)
+			provider.failAt = 2
+			registry := &Registry{Provider: provider, ClusterID: "local"}
+
+			if err := registry.ApplyChanges("example.com", []Change{test.change}); err == nil {
+				t.Fatal("expected the change to fail")
+			}
+			// a record is never left without its owner
+			if got := provider.dump(); strings.Join(got, "\n") != strings.Join(test.expected, "\n") {
+				t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(test.expected, "\n"), strings.Join(got, "\n"))
+			}
+
+			// and the owning GlobalDNS can finish the change
+			if err := registry.ApplyChanges("example.com", []Change{test.change}); err != nil {
+				t.Fatal(err)
+			}
+			var expected []string
+			if test.change.Action != ActionDelete {
+				expected = []string{owned, "app.example.com. A 1.1.1.1"}
+			}
+			if got := provider.dump(); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+				t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestRegistryRecords(t *testing.T) {
+	provider := newFakeProvider(
+		a("mine.example.com", "1.1.1.1", ""),
+		ownerTXT("_globaldns.mine.example.com", "local", "uid1"),
+		a("theirs.example.com", "2.2.2.2", ""),
+		ownerTXT("_globaldns.theirs.example.com", "other", "uid2"),
+		a("manual.example.com", "3.3.3.3", ""),
+	)
+	registry := &Registry{Provider: provider, ClusterID: "local"}
+
+	records, err := registry.Records("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "mine.example.com." || records[0].Owner != "uid1" {
+		t.Fatalf("expected only mine.example.com owned by uid1, got %v", records)
+	}
+}
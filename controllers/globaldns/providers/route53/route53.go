@@ -0,0 +1,468 @@
+package route53
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultEndpoint      = "https://route53.amazonaws.com"
+	DefaultRegion        = "us-east-1"
+	DefaultBatchInterval = time.Second
+
+	apiVersion   = "2013-04-01"
+	apiNamespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+	// Route53 limits a change batch to 1000 values of 32000 characters in
+	// total, counting the values of an UPSERT twice
+	maxBatchValues = 1000
+	maxBatchChars  = 32000
+	maxListItems   = "300"
+	clientTimeout  = 30 * time.Second
+	maxRetryDelay  = 30 * time.Second
+	maxAttempts    = 6
+
+	invalidChangeBatch = "InvalidChangeBatch"
+)
+
+var retryDelay = 500 * time.Millisecond
+
+type Config struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Endpoint overrides the Route53 API URL, e.g. to point at a local mock.
+	Endpoint string
+	Region   string
+	// BatchInterval is how long changes are collected before they are sent
+	// in a single ChangeResourceRecordSets call.
+	BatchInterval time.Duration
+}
+
+type Provider struct {
+	config     Config
+	httpClient *http.Client
+
+	lock    sync.Mutex
+	zoneIDs map[string]string
+	pending map[string]*batch
+}
+
+// batch holds the changes queued for one hosted zone. Every caller waits on
+// done and then reads the result of its own request.
+type batch struct {
+	requests []*request
+	done     chan struct{}
+}
+
+type request struct {
+	changes []providers.Change
+	err     error
+}
+
+type apiError struct {
+	method  string
+	path    string
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("route53: %s %s: %d %s: %s", e.method, e.path, e.status, e.code, e.message)
+}
+
+func NewProvider(config Config) *Provider {
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultEndpoint
+	}
+	if config.Region == "" {
+		config.Region = DefaultRegion
+	}
+	if config.BatchInterval == 0 {
+		config.BatchInterval = DefaultBatchInterval
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	return &Provider{
+		config:     config,
+		httpClient: &http.Client{Timeout: clientTimeout},
+		zoneIDs:    map[string]string{},
+		pending:    map[string]*batch{},
+	}
+}
+
+// Records returns the record sets in zone. Sets using a routing policy or an
+// alias target are left out, since a providers.Record can't describe them
+// well enough to change or delete them.
+func (p *Provider) Records(zone string) ([]providers.Record, error) {
+	zoneID, err := p.hostedZoneID(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []providers.Record
+	query := url.Values{"maxitems": []string{maxListItems}}
+	for {
+		resp := &listResourceRecordSetsResponse{}
+		if err := p.do(http.MethodGet, "/hostedzone/"+zoneID+"/rrset", query, nil, resp); err != nil {
+			return nil, err
+		}
+		for _, set := range resp.ResourceRecordSets {
+			if set.SetIdentifier != "" || set.AliasTarget != nil {
+				continue
+			}
+			records = append(records, fromRecordSet(set))
+		}
+		if !resp.IsTruncated {
+			return records, nil
+		}
+		query.Set("name", resp.NextRecordName)
+		query.Set("type", resp.NextRecordType)
+		if resp.NextRecordIdentifier != "" {
+			query.Set("identifier", resp.NextRecordIdentifier)
+		} else {
+			query.Del("identifier")
+		}
+	}
+}
+
+// ApplyChanges queues changes for zone and blocks until the batch they were
+// added to has been sent. The error returned only concerns these changes.
+func (p *Provider) ApplyChanges(zone string, changes []providers.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	zoneID, err := p.hostedZoneID(zone)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	b, ok := p.pending[zoneID]
+	if !ok {
+		b = &batch{done: make(chan struct{})}
+		p.pending[zoneID] = b
+		time.AfterFunc(p.config.BatchInterval, func() {
+			p.flush(zoneID, b)
+		})
+	}
+	r := &request{changes: dedupe(changes)}
+	b.requests = append(b.requests, r)
+	p.lock.Unlock()
+
+	<-b.done
+	return r.err
+}
+
+func (p *Provider) flush(zoneID string, b *batch) {
+	p.lock.Lock()
+	delete(p.pending, zoneID)
+	p.lock.Unlock()
+
+	defer close(b.done)
+	for _, group := range group(b.requests) {
+		var changes []providers.Change
+		for _, r := range group {
+			changes = append(changes, r.changes...)
+		}
+		logrus.Debugf("route53: sending %d changes for hosted zone %s", len(changes), zoneID)
+		err := p.changeResourceRecordSets(zoneID, changes)
+		if apiErr, ok := err.(*apiError); ok && apiErr.code == invalidChangeBatch && len(group) > 1 {
+			// a single bad change fails the whole batch, send every
+			// request on its own so the others still go through
+			for _, r := range group {
+				r.err = p.changeResourceRecordSets(zoneID, r.changes)
+			}
+			continue
+		}
+		for _, r := range group {
+			r.err = err
+		}
+	}
+}
+
+// group splits requests into batches that each fit in the limits of one
+// ChangeResourceRecordSets call. Route53 rejects a batch that touches the
+// same record set twice, so requests for the same name and type from
+// different callers are put in separate batches and sent in order.
+func group(requests []*request) [][]*request {
+	var (
+		groups [][]*request
+		keys   []map[string]bool
+		sizes  []batchSize
+	)
+	for _, r := range requests {
+		size := sizeOf(r.changes)
+		placed := false
+		for i := range groups {
+			if !sizes[i].add(size).fits() || overlaps(keys[i], r.changes) {
+				continue
+			}
+			// keep a later request behind any earlier one it conflicts with
+			conflict := false
+			for j := i + 1; j < len(groups); j++ {
+				if overlaps(keys[j], r.changes) {
+					conflict = true
+					break
+				}
+			}
+			if conflict {
+				continue
+			}
+			groups[i] = append(groups[i], r)
+			sizes[i] = sizes[i].add(size)
+			for _, change := range r.changes {
+				keys[i][changeKey(change)] = true
+			}
+			placed = true
+			break
+		}
+		if !placed {
+			k := map[string]bool{}
+			for _, change := range r.changes {
+				k[changeKey(change)] = true
+			}
+			groups = append(groups, []*request{r})
+			keys = append(keys, k)
+			sizes = append(sizes, size)
+		}
+	}
+	return groups
+}
+
+type batchSize struct {
+	values int
+	chars  int
+}
+
+func sizeOf(changes []providers.Change) batchSize {
+	var size batchSize
+	for _, change := range changes {
+		n := 1
+		if change.Action == providers.ActionUpsert {
+			n = 2
+		}
+		for _, rr := range toRecordSet(change.Record).ResourceRecords {
+			size.values += n
+			size.chars += n * len(rr.Value)
+		}
+	}
+	return size
+}
+
+func (s batchSize) add(other batchSize) batchSize {
+	return batchSize{values: s.values + other.values, chars: s.chars + other.chars}
+}
+
+func (s batchSize) fits() bool {
+	return s.values <= maxBatchValues && s.chars <= maxBatchChars
+}
+
+func overlaps(keys map[string]bool, changes []providers.Change) bool {
+	for _, change := range changes {
+		if keys[changeKey(change)] {
+			return true
+		}
+	}
+	return false
+}
+
+func changeKey(change providers.Change) string {
+	return providers.Fqdn(change.Record.Name) + "/" + change.Record.Type
+}
+
+func (p *Provider) changeResourceRecordSets(zoneID string, changes []providers.Change) error {
+	req := &changeResourceRecordSetsRequest{Xmlns: apiNamespace}
+	for _, change := range changes {
+		req.ChangeBatch.Changes = append(req.ChangeBatch.Changes, xmlChange{
+			Action:            change.Action,
+			ResourceRecordSet: toRecordSet(change.Record),
+		})
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return p.do(http.MethodPost, "/hostedzone/"+zoneID+"/rrset", nil, body, nil)
+}
+
+func (p *Provider) hostedZoneID(zone string) (string, error) {
+	zone = providers.Fqdn(zone)
+
+	p.lock.Lock()
+	id, ok := p.zoneIDs[zone]
+	p.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	resp := &listHostedZonesByNameResponse{}
+	query := url.Values{"dnsname": []string{zone}, "maxitems": []string{"1"}}
+	if err := p.do(http.MethodGet, "/hostedzonesbyname", query, nil, resp); err != nil {
+		return "", err
+	}
+	if len(resp.HostedZones) == 0 || providers.Fqdn(resp.HostedZones[0].Name) != zone {
+		return "", fmt.Errorf("route53: no hosted zone found for %s", zone)
+	}
+	id = strings.TrimPrefix(resp.HostedZones[0].ID, "/hostedzone/")
+
+	p.lock.Lock()
+	p.zoneIDs[zone] = id
+	p.lock.Unlock()
+	return id, nil
+}
+
+// do sends a signed request, retrying with backoff while Route53 is
+// throttling, and decodes the response into out if it is not nil.
+func (p *Provider) do(method, path string, query url.Values, body []byte, out interface{}) error {
+	u, err := url.Parse(p.config.Endpoint + "/" + apiVersion + path)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = query.Encode()
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := p.send(method, u.String(), body, out)
+		if err == nil || !retry || attempt == maxAttempts {
+			return err
+		}
+		logrus.Debugf("%v, retrying in %v", err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// send makes a single attempt and reports whether a failure is worth
+// retrying.
+func (p *Provider) send(method, rawURL string, body []byte, out interface{}) (bool, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	sign(req, body, p.config.AccessKey, p.config.SecretKey, p.config.SessionToken, p.config.Region, signingService, time.Now())
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if out == nil {
+			return false, nil
+		}
+		return false, xml.Unmarshal(data, out)
+	}
+
+	errResp := &errorResponse{}
+	if err := xml.Unmarshal(data, errResp); err != nil {
+		// not an API error, e.g. from a proxy in between
+		errResp.Error.Message = strings.TrimSpace(string(data))
+	}
+	return isRetryable(resp.StatusCode, errResp.Error.Code), &apiError{
+		method:  method,
+		path:    req.URL.Path,
+		status:  resp.StatusCode,
+		code:    errResp.Error.Code,
+		message: errResp.Error.Message,
+	}
+}
+
+func isRetryable(status int, code string) bool {
+	switch code {
+	case "Throttling", "ThrottlingException", "PriorRequestNotComplete", "RequestLimitExceeded":
+		return true
+	}
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// dedupe keeps only the last of a caller's changes for each name and type,
+// since Route53 rejects a batch that touches the same record set twice.
+func dedupe(changes []providers.Change) []providers.Change {
+	index := map[string]int{}
+	var result []providers.Change
+	for _, change := range changes {
+		key := changeKey(change)
+		if i, ok := index[key]; ok {
+			result[i] = change
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, change)
+	}
+	return result
+}
+
+func toRecordSet(record providers.Record) resourceRecordSet {
+	set := resourceRecordSet{
+		Name: providers.Fqdn(record.Name),
+		Type: record.Type,
+		TTL:  record.TTL,
+	}
+	for _, target := range record.Targets {
+		if record.Type == "TXT" {
+			target = strconv.Quote(target)
+		}
+		set.ResourceRecords = append(set.ResourceRecords, resourceRecord{Value: target})
+	}
+	return set
+}
+
+func fromRecordSet(set resourceRecordSet) providers.Record {
+	record := providers.Record{
+		Name: providers.Fqdn(unescapeName(set.Name)),
+		Type: set.Type,
+		TTL:  set.TTL,
+	}
+	for _, rr := range set.ResourceRecords {
+		value := rr.Value
+		if set.Type == "TXT" {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+		}
+		record.Targets = append(record.Targets, value)
+	}
+	return record
+}
+
+// unescapeName decodes the \ddd octal escapes Route53 uses in returned
+// names, most commonly \052 for a wildcard label.
+func unescapeName(name string) string {
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+	var out strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			if c, err := strconv.ParseUint(name[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(name[i])
+	}
+	return out.String()
+}
@@ -0,0 +1,415 @@
+package route53
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers"
+)
+
+const (
+	hostedZonesResponse = `<ListHostedZonesByNameResponse><HostedZones><HostedZone>` +
+		`<Id>/hostedzone/Z1</Id><Name>example.com.</Name></HostedZone></HostedZones></ListHostedZonesByNameResponse>`
+	changeResponse = `<ChangeResourceRecordSetsResponse/>`
+)
+
+// mock is a minimal Route53 API. rrset handles requests to the record set
+// endpoint of hosted zone Z1.
+type mock struct {
+	sync.Mutex
+	posts    [][]xmlChange
+	requests int
+	rrset    func(w http.ResponseWriter, r *http.Request, body []byte)
+}
+
+func (m *mock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), signingAlgorithm+" Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/" + apiVersion + "/hostedzonesbyname":
+		w.Write([]byte(hostedZonesResponse))
+	case "/" + apiVersion + "/hostedzone/Z1/rrset":
+		body, _ := ioutil.ReadAll(r.Body)
+		m.Lock()
+		m.requests++
+		if r.Method == http.MethodPost {
+			req := &changeResourceRecordSetsRequest{}
+			if err := xml.Unmarshal(body, req); err != nil {
+				m.Unlock()
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			m.posts = append(m.posts, req.ChangeBatch.Changes)
+		}
+		m.Unlock()
+		m.rrset(w, r, body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error></ErrorResponse>`, code, code)
+}
+
+func newTestProvider(m *mock) (*Provider, *httptest.Server) {
+	retryDelay = time.Millisecond
+	server := httptest.NewServer(m)
+	return NewProvider(Config{
+		AccessKey:     "access",
+		SecretKey:     "secret",
+		Endpoint:      server.URL,
+		BatchInterval: 50 * time.Millisecond,
+	}), server
+}
+
+func upsert(name string, targets ...string) providers.Change {
+	return providers.Change{
+		Action: providers.ActionUpsert,
+		Record: providers.Record{Name: name, Type: "A", TTL: 60, Targets: targets},
+	}
+}
+
+func applyConcurrently(p *Provider, changes ...providers.Change) []error {
+	errs := make([]error, len(changes))
+	var wg sync.WaitGroup
+	for i := range changes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.ApplyChanges("example.com", []providers.Change{changes[i]})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestApplyChangesBatchesConcurrentCallers(t *testing.T) {
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		w.Write([]byte(changeResponse))
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+	// resolve the hosted zone first so every caller queues within the interval
+	if _, err := p.hostedZoneID("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := applyConcurrently(p,
+		upsert("a.example.com", "1.1.1.1"),
+		upsert("b.example.com", "2.2.2.2"),
+		upsert("c.example.com", "3.3.3.3"))
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.posts) != 1 || len(m.posts[0]) != 3 {
+		t.Fatalf("expected a single POST with 3 changes, got %v", m.posts)
+	}
+}
+
+func TestRegistryBatchesConcurrentCallers(t *testing.T) {
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`<ListResourceRecordSetsResponse><ResourceRecordSets></ResourceRecordSets>` +
+				`<IsTruncated>false</IsTruncated></ListResourceRecordSetsResponse>`))
+			return
+		}
+		w.Write([]byte(changeResponse))
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+	if _, err := p.hostedZoneID("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	registry := &providers.Registry{Provider: p, ClusterID: "local"}
+
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	for i, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			change := upsert(name, "1.1.1.1")
+			change.Record.Owner = "uid1"
+			errs[i] = registry.ApplyChanges("example.com", []providers.Change{change})
+		}(i, name)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every record and its owner TXT record
+	if len(m.posts) != 1 || len(m.posts[0]) != 6 {
+		t.Fatalf("expected a single POST with 6 changes, got %v", m.posts)
+	}
+}
+
+func TestApplyChangesSeparatesConflictingCallers(t *testing.T) {
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		w.Write([]byte(changeResponse))
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+	if _, err := p.hostedZoneID("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := applyConcurrently(p,
+		upsert("a.example.com", "1.1.1.1"),
+		upsert("a.example.com", "2.2.2.2"))
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.posts) != 2 || len(m.posts[0]) != 1 || len(m.posts[1]) != 1 {
+		t.Fatalf("expected two POSTs with one change each, got %v", m.posts)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes func(i int) providers.Change
+		count   int
+		groups  []int
+	}{
+		{
+			name:    "upserts count twice",
+			changes: func(i int) providers.Change { return upsert(fmt.Sprintf("a%d.example.com", i), "1.1.1.1") },
+			count:   600,
+			groups:  []int{500, 100},
+		},
+		{
+			name: "creates count once",
+			changes: func(i int) providers.Change {
+				change := upsert(fmt.Sprintf("a%d.example.com", i), "1.1.1.1")
+				change.Action = providers.ActionCreate
+				return change
+			},
+			count:  1200,
+			groups: []int{1000, 200},
+		},
+		{
+			name: "characters",
+			changes: func(i int) providers.Change {
+				return providers.Change{
+					Action: providers.ActionCreate,
+					Record: providers.Record{Name: fmt.Sprintf("t%d.example.com", i), Type: "TXT", Targets: []string{strings.Repeat("x", 998)}},
+				}
+			},
+			// 1000 characters once quoted
+			count:  40,
+			groups: []int{32, 8},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests []*request
+			for i := 0; i < test.count; i++ {
+				requests = append(requests, &request{changes: []providers.Change{test.changes(i)}})
+			}
+			var got []int
+			for _, g := range group(requests) {
+				got = append(got, len(g))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.groups) {
+				t.Fatalf("expected groups of %v requests, got %v", test.groups, got)
+			}
+		})
+	}
+}
+
+func TestApplyChangesSplitsInvalidChangeBatch(t *testing.T) {
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if strings.Contains(string(body), "bad.example.com.") {
+			writeError(w, http.StatusBadRequest, invalidChangeBatch)
+			return
+		}
+		w.Write([]byte(changeResponse))
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+	if _, err := p.hostedZoneID("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := applyConcurrently(p,
+		upsert("good.example.com", "1.1.1.1"),
+		upsert("bad.example.com", "2.2.2.2"))
+	if errs[0] != nil {
+		t.Fatalf("expected good change to succeed, got %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), invalidChangeBatch) {
+		t.Fatalf("expected %s for bad change, got %v", invalidChangeBatch, errs[1])
+	}
+	if len(m.posts) != 3 {
+		t.Fatalf("expected the batch and one retry per caller, got %d POSTs", len(m.posts))
+	}
+}
+
+func TestApplyChangesRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		code     string
+		retried  bool
+		attempts int
+	}{
+		{name: "throttling", status: http.StatusBadRequest, code: "Throttling", retried: true},
+		{name: "prior request", status: http.StatusBadRequest, code: "PriorRequestNotComplete", retried: true},
+		{name: "too many requests", status: http.StatusTooManyRequests, retried: true},
+		{name: "server error", status: http.StatusServiceUnavailable, code: "ServiceUnavailable", retried: true},
+		{name: "invalid input", status: http.StatusBadRequest, code: "InvalidInput"},
+		{name: "access denied", status: http.StatusForbidden, code: "AccessDenied"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failures := 0
+			m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+				if failures < 2 {
+					failures++
+					writeError(w, test.status, test.code)
+					return
+				}
+				w.Write([]byte(changeResponse))
+			}}
+			p, server := newTestProvider(m)
+			defer server.Close()
+
+			err := p.ApplyChanges("example.com", []providers.Change{upsert("a.example.com", "1.1.1.1")})
+			if test.retried {
+				if err != nil || m.requests != 3 {
+					t.Fatalf("expected success after 3 attempts, got %v after %d", err, m.requests)
+				}
+			} else if err == nil || m.requests != 1 {
+				t.Fatalf("expected failure after 1 attempt, got %v after %d", err, m.requests)
+			}
+		})
+	}
+}
+
+func TestApplyChangesGivesUpAfterMaxAttempts(t *testing.T) {
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		writeError(w, http.StatusBadRequest, "Throttling")
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+
+	err := p.ApplyChanges("example.com", []providers.Change{upsert("a.example.com", "1.1.1.1")})
+	if err == nil || m.requests != maxAttempts {
+		t.Fatalf("expected failure after %d attempts, got %v after %d", maxAttempts, err, m.requests)
+	}
+}
+
+func TestRecordsPagination(t *testing.T) {
+	pages := map[string]string{
+		"": `<ListResourceRecordSetsResponse><ResourceRecordSets>` +
+			`<ResourceRecordSet><Name>\052.app.example.com.</Name><Type>A</Type><TTL>60</TTL>` +
+			`<ResourceRecords><ResourceRecord><Value>1.1.1.1</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>` +
+			`<ResourceRecordSet><Name>w.example.com.</Name><Type>A</Type><SetIdentifier>one</SetIdentifier><TTL>60</TTL>` +
+			`<ResourceRecords><ResourceRecord><Value>2.2.2.2</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>` +
+			`</ResourceRecordSets><IsTruncated>true</IsTruncated><NextRecordName>w.example.com.</NextRecordName>` +
+			`<NextRecordType>A</NextRecordType><NextRecordIdentifier>two</NextRecordIdentifier></ListResourceRecordSetsResponse>`,
+		"w.example.com./A/two": `<ListResourceRecordSetsResponse><ResourceRecordSets>` +
+			`<ResourceRecordSet><Name>w.example.com.</Name><Type>A</Type><SetIdentifier>two</SetIdentifier><TTL>60</TTL>` +
+			`<ResourceRecords><ResourceRecord><Value>3.3.3.3</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>` +
+			`<ResourceRecordSet><Name>alias.example.com.</Name><Type>A</Type>` +
+			`<AliasTarget><HostedZoneId>Z2</HostedZoneId><DNSName>lb.example.org.</DNSName></AliasTarget></ResourceRecordSet>` +
+			`</ResourceRecordSets><IsTruncated>true</IsTruncated><NextRecordName>x.example.com.</NextRecordName>` +
+			`<NextRecordType>TXT</NextRecordType></ListResourceRecordSetsResponse>`,
+		"x.example.com./TXT/": `<ListResourceRecordSetsResponse><ResourceRecordSets>` +
+			`<ResourceRecordSet><Name>x.example.com.</Name><Type>TXT</Type><TTL>300</TTL>` +
+			`<ResourceRecords><ResourceRecord><Value>"a \"quoted\" value"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>` +
+			`</ResourceRecordSets><IsTruncated>false</IsTruncated></ListResourceRecordSetsResponse>`,
+	}
+	m := &mock{rrset: func(w http.ResponseWriter, r *http.Request, body []byte) {
+		key := ""
+		if q := r.URL.Query(); q.Get("name") != "" {
+			key = q.Get("name") + "/" + q.Get("type") + "/" + q.Get("identifier")
+		}
+		page, ok := pages[key]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		w.Write([]byte(page))
+	}}
+	p, server := newTestProvider(m)
+	defer server.Close()
+
+	records, err := p.Records("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, record := range records {
+		got = append(got, fmt.Sprintf("%s %s %v", record.Name, record.Type, record.Targets))
+	}
+	// weighted and alias record sets are left out
+	expected := []string{
+		"*.app.example.com. A [1.1.1.1]",
+		`x.example.com. TXT [a "quoted" value]`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestTXTQuotingRoundTrip(t *testing.T) {
+	value := `heritage=multi-cluster-app,note="x"`
+	set := toRecordSet(providers.Record{Name: "t.example.com", Type: "TXT", TTL: 300, Targets: []string{value}})
+	if set.ResourceRecords[0].Value != `"heritage=multi-cluster-app,note=\"x\""` {
+		t.Fatalf("unexpected quoted value %s", set.ResourceRecords[0].Value)
+	}
+	if record := fromRecordSet(set); record.Targets[0] != value {
+		t.Fatalf("expected %s after round trip, got %s", value, record.Targets[0])
+	}
+}
+
+// TestSign checks sign against the get-vanilla and post-vanilla cases of the
+// AWS signature version 4 test suite.
+func TestSign(t *testing.T) {
+	tests := []struct {
+		method    string
+		url       string
+		signature string
+	}{
+		{
+			method:    http.MethodGet,
+			url:       "https://example.amazonaws.com/",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			method:    http.MethodPost,
+			url:       "https://example.amazonaws.com/",
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	now, _ := time.Parse(amzDateFormat, "20150830T123600Z")
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		sign(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", "us-east-1", "service", now)
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + test.signature
+		if got := req.Header.Get("Authorization"); got != expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.method, expected, got)
+		}
+	}
+}
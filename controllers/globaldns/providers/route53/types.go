@@ -0,0 +1,56 @@
+package route53
+
+import "encoding/xml"
+
+type changeResourceRecordSetsRequest struct {
+	XMLName     xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	ChangeBatch struct {
+		Changes []xmlChange `xml:"Changes>Change"`
+	}
+}
+
+type xmlChange struct {
+	Action            string
+	ResourceRecordSet resourceRecordSet
+}
+
+type resourceRecordSet struct {
+	Name            string
+	Type            string
+	SetIdentifier   string           `xml:",omitempty"`
+	TTL             int64            `xml:",omitempty"`
+	ResourceRecords []resourceRecord `xml:"ResourceRecords>ResourceRecord,omitempty"`
+	AliasTarget     *aliasTarget     `xml:",omitempty"`
+}
+
+type aliasTarget struct {
+	DNSName string
+}
+
+type resourceRecord struct {
+	Value string
+}
+
+type listResourceRecordSetsResponse struct {
+	ResourceRecordSets   []resourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated          bool
+	NextRecordName       string
+	NextRecordType       string
+	NextRecordIdentifier string
+}
+
+type listHostedZonesByNameResponse struct {
+	HostedZones []struct {
+		ID   string `xml:"Id"`
+		Name string
+	} `xml:"HostedZones>HostedZone"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Type    string
+		Code    string
+		Message string
+	}
+}
@@ -0,0 +1,96 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const lookupTimeout = 5 * time.Second
+
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// RecordsForTargets builds the record sets that publish targets under name.
+// IPv4 and IPv6 addresses become A and AAAA records. A single hostname is
+// published as a CNAME. Several hostnames, hostnames mixed with addresses,
+// or a hostname for the apex of zone, are resolved to A and AAAA records
+// since a CNAME can't share its name with other records. Hostnames that fail to resolve are skipped,
+// and an error is only returned if none of the targets could be used.
+func RecordsForTargets(zone, name string, ttl int64, targets []string) ([]Record, error) {
+	var ipv4, ipv6, hostnames []string
+	for _, target := range targets {
+		if ip := net.ParseIP(target); ip != nil {
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip.String())
+			} else {
+				ipv6 = append(ipv6, ip.String())
+			}
+		} else if target != "" {
+			hostnames = append(hostnames, Fqdn(target))
+		}
+	}
+	hostnames = unique(hostnames)
+
+	if len(hostnames) == 1 && len(ipv4) == 0 && len(ipv6) == 0 && Fqdn(name) != Fqdn(zone) {
+		return []Record{{Name: Fqdn(name), Type: "CNAME", TTL: ttl, Targets: hostnames}}, nil
+	}
+
+	var lastErr error
+	for _, hostname := range hostnames {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		ips, err := lookupIP(ctx, strings.TrimSuffix(hostname, "."))
+		cancel()
+		if err != nil {
+			logrus.Warnf("skipping target %s of %s: %v", hostname, name, err)
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip.String())
+			} else {
+				ipv6 = append(ipv6, ip.String())
+			}
+		}
+	}
+
+	var records []Record
+	if ipv4 = unique(ipv4); len(ipv4) > 0 {
+		records = append(records, Record{Name: Fqdn(name), Type: "A", TTL: ttl, Targets: ipv4})
+	}
+	if ipv6 = unique(ipv6); len(ipv6) > 0 {
+		records = append(records, Record{Name: Fqdn(name), Type: "AAAA", TTL: ttl, Targets: ipv6})
+	}
+	if len(records) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed to resolve any target of %s: %v", name, lastErr)
+	}
+	return records, nil
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,145 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRecordsForTargets(t *testing.T) {
+	hosts := map[string][]string{
+		"v4.example.org":   {"1.1.1.1", "2.2.2.2"},
+		"v6.example.org":   {"2001:db8::1"},
+		"dual.example.org": {"2.2.2.2", "2001:db8::2"},
+	}
+	defer func(original func(context.Context, string) ([]net.IP, error)) { lookupIP = original }(lookupIP)
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, errors.New("lookup without a deadline")
+		}
+		addresses, ok := hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		var ips []net.IP
+		for _, address := range addresses {
+			ips = append(ips, net.ParseIP(address))
+		}
+		return ips, nil
+	}
+
+	tests := []struct {
+		name     string
+		record   string
+		targets  []string
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "IPv4 only",
+			targets:  []string{"2.2.2.2", "1.1.1.1"},
+			expected: []string{"app.example.com. A 1.1.1.1,2.2.2.2"},
+		},
+		{
+			name:     "IPv6 only",
+			targets:  []string{"2001:db8::1"},
+			expected: []string{"app.example.com. AAAA 2001:db8::1"},
+		},
+		{
+			name:     "single hostname",
+			targets:  []string{"LB.Example.org"},
+			expected: []string{"app.example.com. CNAME lb.example.org."},
+		},
+		{
+			name:     "single hostname at the apex",
+			record:   "Example.com",
+			targets:  []string{"dual.example.org"},
+			expected: []string{"example.com. A 2.2.2.2", "example.com. AAAA 2001:db8::2"},
+		},
+		{
+			name:    "single unresolvable hostname at the apex",
+			record:  "example.com.",
+			targets: []string{"missing.example.org"},
+			err:     true,
+		},
+		{
+			name:     "single hostname is not resolved",
+			targets:  []string{"missing.example.org", "missing.example.org."},
+			expected: []string{"app.example.com. CNAME missing.example.org."},
+		},
+		{
+			name:    "several hostnames",
+			targets: []string{"v4.example.org", "v6.example.org", "dual.example.org"},
+			expected: []string{
+				"app.example.com. A 1.1.1.1,2.2.2.2",
+				"app.example.com. AAAA 2001:db8::1,2001:db8::2",
+			},
+		},
+		{
+			name:    "hostnames mixed with addresses",
+			targets: []string{"v6.example.org", "3.3.3.3"},
+			expected: []string{
+				"app.example.com. A 3.3.3.3",
+				"app.example.com. AAAA 2001:db8::1",
+			},
+		},
+		{
+			name:     "IPv4-mapped IPv6 address",
+			targets:  []string{"::ffff:1.1.1.1"},
+			expected: []string{"app.example.com. A 1.1.1.1"},
+		},
+		{
+			name:     "duplicates",
+			targets:  []string{"1.1.1.1", "v4.example.org", "::ffff:2.2.2.2", ""},
+			expected: []string{"app.example.com. A 1.1.1.1,2.2.2.2"},
+		},
+		{
+			name:     "failing hostname is skipped",
+			targets:  []string{"v4.example.org", "missing.example.org"},
+			expected: []string{"app.example.com. A 1.1.1.1,2.2.2.2"},
+		},
+		{
+			name:     "failing hostname next to an address is skipped",
+			targets:  []string{"missing.example.org", "3.3.3.3"},
+			expected: []string{"app.example.com. A 3.3.3.3"},
+		},
+		{
+			name:    "no hostname resolves",
+			targets: []string{"missing.example.org", "other.example.org"},
+			err:     true,
+		},
+		{
+			name:    "no targets",
+			targets: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := test.record
+			if name == "" {
+				name = "app.example.com"
+			}
+			records, err := RecordsForTargets("example.com", name, 60, test.targets)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", records)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, record := range records {
+				got = append(got, fmt.Sprintf("%s %s %s", record.Name, record.Type, strings.Join(record.Targets, ",")))
+			}
+			if strings.Join(got, "\n") != strings.Join(test.expected, "\n") {
+				t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(test.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
@@ -3,10 +3,11 @@ package globaldns
 import (
 	"context"
 
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers/embedded"
 	"github.com/rancher/types/config"
 )
 
-func Register(ctx context.Context, management *config.ManagementContext) {
-	n := newGlobalDNSController(management)
+func Register(ctx context.Context, management *config.ManagementContext, dnsServer *embedded.Server) {
+	n := newGlobalDNSController(management, dnsServer)
 	management.Management.GlobalDNSs("").AddHandler(GlobaldnsController, n.sync)
 }
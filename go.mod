@@ -7,6 +7,7 @@ require (
 	github.com/sirupsen/logrus v1.0.4-0.20170822132746-89742aefa4b2
 	github.com/urfave/cli v1.18.0 // indirect
 	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba // indirect
+	k8s.io/apimachinery v0.0.0-20180619225948-e386b2658ed2
 	k8s.io/client-go v2.0.0-alpha.0.0.20180621152933-b0722d92a7c1+incompatible
 
 )
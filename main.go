@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers/embedded"
 	"github.com/rancher/multi-cluster-app/server"
 	"github.com/rancher/norman/store/proxy"
 	"github.com/rancher/types/config"
@@ -37,7 +38,22 @@ func run() error {
 	}
 	management.ClientGetter = client
 
-	handler, err := server.NewMultiClusterAppServer(context.Background(), management)
+	ctx := context.Background()
+
+	var dnsServer *embedded.Server
+	if port := os.Getenv("DNS_PORT"); port != "" {
+		nameserver := os.Getenv("DNS_NAMESERVER")
+		if nameserver == "" {
+			return fmt.Errorf("DNS_NAMESERVER must be set when DNS_PORT is set")
+		}
+		dnsServer = embedded.NewServer(nameserver)
+		if err := dnsServer.Start(ctx, "0.0.0.0:"+port); err != nil {
+			return err
+		}
+		fmt.Println("Serving DNS on 0.0.0.0:" + port)
+	}
+
+	handler, err := server.NewMultiClusterAppServer(ctx, management, dnsServer)
 	if err != nil {
 		return err
 	}
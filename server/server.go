@@ -6,13 +6,14 @@ import (
 
 	"github.com/rancher/multi-cluster-app/api/setup"
 	"github.com/rancher/multi-cluster-app/controllers"
+	"github.com/rancher/multi-cluster-app/controllers/globaldns/providers/embedded"
 	normanapi "github.com/rancher/norman/api"
 	"github.com/rancher/norman/types"
 	managementSchema "github.com/rancher/types/apis/management.cattle.io/v3/schema"
 	"github.com/rancher/types/config"
 )
 
-func NewMultiClusterAppServer(ctx context.Context, management *config.ManagementContext) (http.Handler, error) {
+func NewMultiClusterAppServer(ctx context.Context, management *config.ManagementContext, dnsServer *embedded.Server) (http.Handler, error) {
 
 	schemas := types.NewSchemas().AddSchemas(managementSchema.MultiClusterAppSchemas)
 	if err := setup.Schemas(ctx, management, schemas); err != nil {
@@ -24,7 +25,7 @@ func NewMultiClusterAppServer(ctx context.Context, management *config.Management
 		return nil, err
 	}
 
-	controllers.Register(ctx, management)
+	controllers.Register(ctx, management, dnsServer)
 	if err := management.Start(ctx); err != nil {
 		panic(err)
 	}